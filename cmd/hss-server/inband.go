@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smparser"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+// INBAND_SECURITY_TLS is the TLS value of Inband-Security-Id.
+const INBAND_SECURITY_TLS = 1
+
+// listenInbandTLS accepts connections that negotiate TLS with
+// Inband-Security-Id in the capabilities exchange (RFC 6733 section 6.10),
+// as well as plain ones.
+func listenInbandTLS(addr, cert, key string, mux *sm.StateMachine) error {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Starting diameter server with in-band tls on", addr)
+	for {
+		rw, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveInbandTLS(rw, cfg, mux)
+	}
+}
+
+// serveInbandTLS reads the CER on rw. When it asks for TLS, the CEA is sent
+// in the clear and the connection upgraded before go-diameter serves it;
+// otherwise the state machine handles the CER as usual.
+func serveInbandTLS(rw net.Conn, cfg *tls.Config, mux *sm.StateMachine) {
+	addr := rw.RemoteAddr().String()
+	m, err := diam.ReadMessage(rw, dict.Default)
+	if err != nil {
+		log.Printf("Failed to read CER from %s: %s", addr, err)
+		rw.Close()
+		return
+	}
+	if m.Header.CommandCode != diam.CapabilitiesExchange || !asksInbandTLS(m) {
+		c, err := diam.NewConn(rw, addr, mux, dict.Default)
+		if err != nil {
+			log.Printf("Failed to serve %s: %s", addr, err)
+			return
+		}
+		mux.ServeDIAM(c, m)
+		return
+	}
+
+	cer := new(smparser.CER)
+	if _, err := cer.Parse(withoutInbandSecurity(m), smparser.Server); err != nil {
+		log.Printf("Invalid CER from %s: %s", addr, err)
+		rw.Close()
+		return
+	}
+	if _, err := inbandTLSCEA(mux.Settings(), m, rw.LocalAddr()).WriteTo(rw); err != nil {
+		log.Printf("Failed to send CEA to %s: %s", addr, err)
+		rw.Close()
+		return
+	}
+	conn := tls.Server(rw, cfg)
+	if err := conn.Handshake(); err != nil {
+		log.Printf("TLS handshake with %s failed: %s", addr, err)
+		rw.Close()
+		return
+	}
+	// The state machine only serves peers whose metadata is in the
+	// context, which its own CER handler would have set.
+	meta := smpeer.FromCER(cer)
+	handler := diam.HandlerFunc(func(c diam.Conn, m *diam.Message) {
+		if _, ok := smpeer.FromContext(c.Context()); !ok {
+			c.SetContext(smpeer.NewContext(c.Context(), meta))
+		}
+		mux.ServeDIAM(c, m)
+	})
+	if _, err := diam.NewConn(conn, addr, handler, dict.Default); err != nil {
+		log.Printf("Failed to serve %s: %s", addr, err)
+	}
+}
+
+func asksInbandTLS(m *diam.Message) bool {
+	a, err := m.FindAVP(avp.InbandSecurityID, 0)
+	return err == nil && a.Data == datatype.Unsigned32(INBAND_SECURITY_TLS)
+}
+
+// withoutInbandSecurity returns a copy of m without Inband-Security-Id,
+// which smparser rejects.
+func withoutInbandSecurity(m *diam.Message) *diam.Message {
+	stripped := *m
+	stripped.AVP = nil
+	for _, a := range m.AVP {
+		if a.Code != avp.InbandSecurityID {
+			stripped.AVP = append(stripped.AVP, a)
+		}
+	}
+	return &stripped
+}
+
+func inbandTLSCEA(settings *sm.Settings, m *diam.Message, local net.Addr) *diam.Message {
+	a := m.Answer(diam.Success)
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	if tcpAddr, ok := local.(*net.TCPAddr); ok {
+		a.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(tcpAddr.IP))
+	}
+	a.NewAVP(avp.VendorID, avp.Mbit, 0, settings.VendorID)
+	a.NewAVP(avp.ProductName, 0, 0, settings.ProductName)
+	for _, app := range sm.PrepareSupportedApps(dict.Default) {
+		typ := uint32(avp.AuthApplicationID)
+		if app.AppType == "acct" {
+			typ = avp.AcctApplicationID
+		}
+		if app.Vendor == 0 {
+			a.NewAVP(typ, avp.Mbit, 0, datatype.Unsigned32(app.ID))
+			continue
+		}
+		a.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(app.Vendor)),
+				diam.NewAVP(typ, avp.Mbit, 0, datatype.Unsigned32(app.ID)),
+			},
+		})
+	}
+	a.NewAVP(avp.InbandSecurityID, avp.Mbit, 0, datatype.Unsigned32(INBAND_SECURITY_TLS))
+	a.NewAVP(avp.FirmwareRevision, 0, 0, settings.FirmwareRevision)
+	return a
+}
@@ -8,6 +8,8 @@
 //   go run $GOROOT/src/crypto/tls/generate_cert.go --host localhost
 //
 // And start the server with `-cert_file cert.pem -key_file key.pem`.
+// Add `-inband_tls` to upgrade to TLS after the capabilities exchange
+// instead, for clients that send Inband-Security-Id 1 (TLS) in the CER.
 //
 // By default this server runs in a single OS thread. If you want to
 // make it run on more, set the GOMAXPROCS=n environment variable.
@@ -20,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"io"
 
@@ -44,6 +47,11 @@ func main() {
 	certFile := flag.String("cert_file", "", "tls certificate file (optional)")
 	keyFile := flag.String("key_file", "", "tls key file (optional)")
 	networkType := flag.String("network_type", "tcp", "protocol type tcp/sctp")
+	sctpLocalAddrs := flag.String("sctp_local_addrs", "", "comma separated extra local addresses to bind for sctp multi-homing")
+	sctpOstreams := flag.Uint("sctp_ostreams", 0, "number of sctp outbound streams (default 16)")
+	sctpIstreams := flag.Uint("sctp_istreams", 0, "maximum number of sctp inbound streams (default 16)")
+	sctpPPID := flag.Uint("sctp_ppid", 0, "sctp payload protocol identifier (default 46)")
+	inbandTLS := flag.Bool("inband_tls", false, "upgrade to tls after the capabilities exchange when the client asks for it")
 	flag.Parse()
 
 	settings := &sm.Settings{
@@ -59,7 +67,9 @@ func main() {
 
 	mux.Handle("ULR", handleULR(*settings))
 	mux.Handle("AIR", handleAIR(*settings))
-	// TODO: Impli Notify Request
+	mux.Handle("PUR", handlePUR(*settings))
+	mux.Handle("NOR", handleNOR(*settings))
+	mux.Handle("DPR", handleDPR(*settings))
 	mux.HandleFunc("ALL", handleALL) // Catch all.
 
 	// Print error reports.
@@ -69,7 +79,19 @@ func main() {
 		go func() { log.Fatal(http.ListenAndServe(*ppaddr, nil)) }()
 	}
 
-	err := listen(*networkType, *addr, *certFile, *keyFile, mux)
+	var err error
+	switch {
+	case *inbandTLS:
+		err = listenInbandTLS(*addr, *certFile, *keyFile, mux)
+	case strings.HasPrefix(*networkType, "sctp") && len(*certFile) == 0:
+		opts := sctpOptions{ostreams: *sctpOstreams, istreams: *sctpIstreams, ppid: *sctpPPID}
+		if len(*sctpLocalAddrs) > 0 {
+			opts.localAddrs = strings.Split(*sctpLocalAddrs, ",")
+		}
+		err = listenSCTP(*networkType, *addr, opts, mux)
+	default:
+		err = listen(*networkType, *addr, *certFile, *keyFile, mux)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -237,6 +259,63 @@ func handleULR(settings sm.Settings) diam.HandlerFunc {
 	}
 }
 
+// PUR-Flags and PUA-Flags bits, TS 29.272 7.3.149 and 7.3.48
+const (
+	PUR_FLAGS_UE_PURGED_IN_MME = 1 << 0
+	PUA_FLAGS_FREEZE_M_TMSI    = 1 << 0
+)
+
+func handlePUR(settings sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		fmt.Println(m)
+		a := s6aAnswer(settings, m)
+		// Freeze the M-TMSI of a UE purged in the MME
+		if flags, err := m.FindAVP(avp.PURFlags, VENDOR_3GPP); err == nil {
+			if v, ok := flags.Data.(datatype.Unsigned32); ok && v&PUR_FLAGS_UE_PURGED_IN_MME != 0 {
+				a.NewAVP(avp.PUAFlags, avp.Vbit|avp.Mbit, VENDOR_3GPP, datatype.Unsigned32(PUA_FLAGS_FREEZE_M_TMSI))
+			}
+		}
+		if _, err := a.WriteTo(c); err != nil {
+			log.Printf("Failed to send PUA: %s", err.Error())
+		}
+	}
+}
+
+func handleNOR(settings sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		fmt.Println(m)
+		if _, err := s6aAnswer(settings, m).WriteTo(c); err != nil {
+			log.Printf("Failed to send NOA: %s", err.Error())
+		}
+	}
+}
+
+// s6aAnswer returns a successful answer to the S6a request m.
+func s6aAnswer(settings sm.Settings, m *diam.Message) *diam.Message {
+	a := m.Answer(diam.Success)
+	if sid, err := m.FindAVP(avp.SessionID, 0); err == nil {
+		a.InsertAVP(sid)
+	}
+	if state, err := m.FindAVP(avp.AuthSessionState, 0); err == nil {
+		a.AddAVP(state)
+	}
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	return a
+}
+
+func handleDPR(settings sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		fmt.Println(m)
+		a := m.Answer(diam.Success)
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+		if _, err := a.WriteTo(c); err != nil {
+			log.Printf("Failed to send DPA: %s", err.Error())
+		}
+	}
+}
+
 func printErrors(ec <-chan *diam.ErrorReport) {
 	for err := range ec {
 		log.Println(err)
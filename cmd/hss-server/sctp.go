@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/ishidawataru/sctp"
+
+	"github.com/bbsakura/xk6-diameter/pkg/sctpconn"
+)
+
+// sctpOptions tunes the SCTP associations accepted by the server.
+type sctpOptions struct {
+	localAddrs []string
+	ostreams   uint
+	istreams   uint
+	ppid       uint
+}
+
+// listenSCTP serves SCTP associations on addr, also bound to the extra local
+// addresses for multi-homing.
+func listenSCTP(network, addr string, opts sctpOptions, handler diam.Handler) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	laddr, err := sctp.ResolveSCTPAddr(network, net.JoinHostPort(strings.Join(append([]string{host}, opts.localAddrs...), "/"), port))
+	if err != nil {
+		return err
+	}
+	initMsg := sctp.InitMsg{NumOstreams: diam.MaxOutboundSCTPStreams, MaxInstreams: diam.MaxInboundSCTPStreams}
+	if opts.ostreams > 0 {
+		initMsg.NumOstreams = uint16(opts.ostreams)
+	}
+	if opts.istreams > 0 {
+		initMsg.MaxInstreams = uint16(opts.istreams)
+	}
+	ppid := diam.DiameterPPID
+	if opts.ppid > 0 {
+		ppid = uint32(opts.ppid)
+	}
+	ln, err := sctp.ListenSCTPExt(network, laddr, initMsg)
+	if err != nil {
+		return err
+	}
+	log.Println("Starting diameter server on", laddr)
+	return diam.Serve(sctpListener{SCTPListener: ln, ppid: ppid}, handler)
+}
+
+type sctpListener struct {
+	*sctp.SCTPListener
+	ppid uint32
+}
+
+func (l sctpListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptSCTP()
+	if err != nil {
+		return nil, err
+	}
+	return sctpconn.New(conn, l.ppid), nil
+}
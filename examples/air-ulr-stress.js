@@ -23,11 +23,12 @@ export default function () {
             network_type: "sctp",
             retries: 0,
             vendor_id: 10415,
+            app_id: 16777251,
             product_name: "xk6-diameter",
             hostipaddresses: ["127.0.0.1"],
         });
         check(result, {
-            "Connected": (result) => result == true,
+            "Connected": (r) => r.result_code === 2001,
         });
     } catch (error) {
         check(null, {
@@ -0,0 +1,122 @@
+package diameter
+
+import (
+	"github.com/grafana/sobek"
+	"go.k6.io/k6/js/promises"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// RequestAsync is the asynchronous version of Request. The returned promise
+// is resolved with the answer on the VU's event loop, so a VU can have many
+// requests outstanding at once.
+func (c *K6DiameterClient) RequestAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseRequestOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.request(options)
+	})
+}
+
+// CheckSendAIRAsync is the asynchronous version of CheckSendAIR.
+func (c *K6DiameterClient) CheckSendAIRAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseConnectionOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendAIR(options)
+	})
+}
+
+// CheckSendULRAsync is the asynchronous version of CheckSendULR.
+func (c *K6DiameterClient) CheckSendULRAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseConnectionOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendULR(options)
+	})
+}
+
+func (c *K6DiameterClient) async(fn func() (interface{}, error)) *sobek.Promise {
+	promise, resolve, reject := promises.New(c.vu)
+	go func() {
+		v, err := fn()
+		if err != nil {
+			reject(err)
+			return
+		}
+		resolve(v)
+	}()
+	return promise
+}
+
+// CheckSendPURAsync is the asynchronous version of CheckSendPUR.
+func (c *K6DiameterClient) CheckSendPURAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseConnectionOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendPUR(options)
+	})
+}
+
+// CheckSendNORAsync is the asynchronous version of CheckSendNOR.
+func (c *K6DiameterClient) CheckSendNORAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseConnectionOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendNOR(options)
+	})
+}
+
+// CheckSendUARAsync is the asynchronous version of CheckSendUAR.
+func (c *K6DiameterClient) CheckSendUARAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseCxRequestOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendCx(cmdUserAuthorization, options)
+	})
+}
+
+// CheckSendSARAsync is the asynchronous version of CheckSendSAR.
+func (c *K6DiameterClient) CheckSendSARAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseCxRequestOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendCx(diam.ServerAssignment, options)
+	})
+}
+
+// CheckSendLIRAsync is the asynchronous version of CheckSendLIR.
+func (c *K6DiameterClient) CheckSendLIRAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseCxRequestOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendCx(cmdLocationInfo, options)
+	})
+}
+
+// CheckSendMARAsync is the asynchronous version of CheckSendMAR.
+func (c *K6DiameterClient) CheckSendMARAsync(v sobek.Value) *sobek.Promise {
+	options, err := parseCxRequestOptions(v)
+	return c.async(func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return c.checkSendCx(diam.MultimediaAuth, options)
+	})
+}
@@ -30,17 +30,17 @@ type AVPMetaC struct {
 }
 
 func (pair *AVP) modifyMessage(m *diam.Message, meta *smpeer.Metadata) error {
-	avpMeta, ok := avpDict[pair.Key]
-	if !ok {
-		return errors.New("not found AVP")
+	avpMeta, err := lookupAVP(pair.Key)
+	if err != nil {
+		return withAVPPath(pair.Key, err)
 	}
 	val, err := avpMeta.converter(pair.Value)
 	if err != nil {
-		return err
+		return withAVPPath(pair.Key, err)
 	}
-	_, err = m.NewAVP(pair.Key, avpMeta.flag, avpMeta.vendor, val)
+	_, err = m.NewAVP(avpMeta.code, avpMeta.flag, avpMeta.vendor, val)
 	if err != nil {
-		return err
+		return withAVPPath(pair.Key, err)
 	}
 	return nil
 }
@@ -53,12 +53,18 @@ func appendAVPs(m *diam.Message, meta *smpeer.Metadata, avps []AVP) error {
 			errs = append(errs, err)
 		}
 	}
-	if len(errs) > 0 {
-		return errors.Join(errs...)
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		// A single error is kept as is, so that scripts can read its fields.
+		return errs[0]
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
+// modifyMessage adds Destination-Host and Destination-Realm, those of the
+// peer unless set in options. Empty values leave them out.
 func modifyMessage(m *diam.Message, meta *smpeer.Metadata, options ConnectionOptions) error {
 	if options.DestinationHost == nil {
 		_, err := m.NewAVP(avp.DestinationHost, avp.Mbit, 0, meta.OriginHost)
@@ -76,7 +82,7 @@ func modifyMessage(m *diam.Message, meta *smpeer.Metadata, options ConnectionOpt
 		if err != nil {
 			return err
 		}
-	} else {
+	} else if *options.DestinationRealm != "" {
 		_, err := m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, *options.DestinationRealm)
 		if err != nil {
 			return err
@@ -84,3 +90,26 @@ func modifyMessage(m *diam.Message, meta *smpeer.Metadata, options ConnectionOpt
 	}
 	return nil
 }
+
+// resultCodes returns the Result-Code and Experimental-Result-Code of an answer.
+func resultCodes(m *diam.Message) (resultCode, experimentalResultCode uint32) {
+	for _, a := range m.AVP {
+		switch a.Code {
+		case avp.ResultCode:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				resultCode = uint32(v)
+			}
+		case avp.ExperimentalResult:
+			group, ok := a.Data.(*diam.GroupedAVP)
+			if !ok {
+				continue
+			}
+			for _, member := range group.AVP {
+				if v, ok := member.Data.(datatype.Unsigned32); ok && member.Code == avp.ExperimentalResultCode {
+					experimentalResultCode = uint32(v)
+				}
+			}
+		}
+	}
+	return resultCode, experimentalResultCode
+}
@@ -1,6 +1,11 @@
 package diameter
 
 import (
+	"math"
+	"math/big"
+	"net"
+	"time"
+
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
 )
@@ -25,13 +30,13 @@ func toGrouped(v interface{}) (datatype.Type, error) {
 			return nil, &ErrNoValue{key}
 		}
 
-		avpMeta, ok := avpDict[key]
-		if !ok {
-			return nil, &ErrNotFound{key}
+		avpMeta, err := lookupAVP(key)
+		if err != nil {
+			return nil, withAVPPath(key, err)
 		}
 		val, err := avpMeta.converter(value)
 		if err != nil {
-			return nil, err
+			return nil, withAVPPath(key, err)
 		}
 		members = append(members, diam.NewAVP(avpMeta.code, avpMeta.flag, avpMeta.vendor, val))
 	}
@@ -63,29 +68,219 @@ func toOctetString(v interface{}) (datatype.Type, error) {
 }
 
 func toEnumerated(v interface{}) (datatype.Type, error) {
-	val, ok := v.(int64)
-	if !ok {
-		return nil, &ErrInvalidType{Value: v, Want: "int32"}
+	val, err := toInt(v, math.MinInt32, math.MaxInt32, "int32")
+	if err != nil {
+		return nil, err
 	}
 	return datatype.Enumerated(val), nil
 }
 
+func toInteger32(v interface{}) (datatype.Type, error) {
+	val, err := toInt(v, math.MinInt32, math.MaxInt32, "int32")
+	if err != nil {
+		return nil, err
+	}
+	return datatype.Integer32(val), nil
+}
+
+func toInteger64(v interface{}) (datatype.Type, error) {
+	switch val := v.(type) {
+	case int64:
+		return datatype.Integer64(val), nil
+	case *big.Int:
+		if val.IsInt64() {
+			return datatype.Integer64(val.Int64()), nil
+		}
+	}
+	return nil, &ErrInvalidType{Value: v, Want: "int64 number or BigInt"}
+}
+
 func toUnsigned32(v interface{}) (datatype.Type, error) {
-	val, ok := v.(int64)
-	if !ok {
-		return nil, &ErrInvalidType{Value: v, Want: "uint32"}
+	val, err := toInt(v, 0, math.MaxUint32, "uint32")
+	if err != nil {
+		return nil, err
 	}
 	return datatype.Unsigned32(val), nil
 }
 
+func toUnsigned64(v interface{}) (datatype.Type, error) {
+	switch val := v.(type) {
+	case int64:
+		if val >= 0 {
+			return datatype.Unsigned64(val), nil
+		}
+	case *big.Int:
+		if val.IsUint64() {
+			return datatype.Unsigned64(val.Uint64()), nil
+		}
+	}
+	return nil, &ErrInvalidType{Value: v, Want: "uint64 number or BigInt"}
+}
+
+func toFloat32(v interface{}) (datatype.Type, error) {
+	val, err := toFloat(v, "float32")
+	if err != nil {
+		return nil, err
+	}
+	return datatype.Float32(val), nil
+}
+
+func toFloat64(v interface{}) (datatype.Type, error) {
+	val, err := toFloat(v, "float64")
+	if err != nil {
+		return nil, err
+	}
+	return datatype.Float64(val), nil
+}
+
+func toDiameterIdentity(v interface{}) (datatype.Type, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: "string"}
+	}
+	return datatype.DiameterIdentity(val), nil
+}
+
+func toDiameterURI(v interface{}) (datatype.Type, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: "string"}
+	}
+	return datatype.DiameterURI(val), nil
+}
+
+func toIPFilterRule(v interface{}) (datatype.Type, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: "string"}
+	}
+	return datatype.IPFilterRule(val), nil
+}
+
+func toQoSFilterRule(v interface{}) (datatype.Type, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: "string"}
+	}
+	return datatype.QoSFilterRule(val), nil
+}
+
+func toAddress(v interface{}) (datatype.Type, error) {
+	ip, err := toIP(v, "IP address string")
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return datatype.Address(ip4), nil
+	}
+	return datatype.Address(ip), nil
+}
+
+func toIPv4(v interface{}) (datatype.Type, error) {
+	ip, err := toIP(v, "IPv4 address string")
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, &ErrInvalidType{Value: v, Want: "IPv4 address string"}
+	}
+	return datatype.IPv4(ip4), nil
+}
+
+func toIPv6(v interface{}) (datatype.Type, error) {
+	ip, err := toIP(v, "IPv6 address string")
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, &ErrInvalidType{Value: v, Want: "IPv6 address string"}
+	}
+	return datatype.IPv6(ip), nil
+}
+
+// toIPv6Prefix encodes a prefix such as "2001:db8::/64" in the RFC 3162
+// format used by Framed-IPv6-Prefix and Delegated-IPv6-Prefix. There is no
+// IPv4 counterpart, as the built-in dictionaries define no IPv4 prefix AVP.
+func toIPv6Prefix(v interface{}) (datatype.Type, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: "IPv6 prefix string"}
+	}
+	_, prefix, err := net.ParseCIDR(val)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, &ErrInvalidType{Value: v, Want: "IPv6 prefix string"}
+	}
+	length, _ := prefix.Mask.Size()
+	b := []byte{0, byte(length)}
+	b = append(b, prefix.IP[:(length+7)/8]...)
+	return datatype.OctetString(b), nil
+}
+
+// toTime accepts a JS Date or an RFC 3339 string.
+func toTime(v interface{}) (datatype.Type, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return datatype.Time(val), nil
+	case string:
+		t, err := time.Parse(time.RFC3339, val)
+		if err == nil {
+			return datatype.Time(t), nil
+		}
+	}
+	return nil, &ErrInvalidType{Value: v, Want: "Date or RFC 3339 string"}
+}
+
+func toInt(v interface{}, min, max int64, want string) (int64, error) {
+	switch val := v.(type) {
+	case int64:
+		if val >= min && val <= max {
+			return val, nil
+		}
+	case *big.Int:
+		if val.IsInt64() && val.Int64() >= min && val.Int64() <= max {
+			return val.Int64(), nil
+		}
+	}
+	return 0, &ErrInvalidType{Value: v, Want: want}
+}
+
+func toFloat(v interface{}, want string) (float64, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case int64:
+		return float64(val), nil
+	}
+	return 0, &ErrInvalidType{Value: v, Want: want}
+}
+
+func toIP(v interface{}, want string) (net.IP, error) {
+	val, ok := v.(string)
+	if !ok {
+		return nil, &ErrInvalidType{Value: v, Want: want}
+	}
+	ip := net.ParseIP(val)
+	if ip == nil {
+		return nil, &ErrInvalidType{Value: v, Want: want}
+	}
+	return ip, nil
+}
+
 func convertInt64SliceToString(v interface{}) (string, error) {
+	if b, ok := v.([]byte); ok {
+		return string(b), nil
+	}
 	bval, ok := v.([]interface{})
 	if !ok {
 		return "", &ErrInvalidType{Value: v, Want: "string or []byte"}
 	}
 	var bites []byte
 	for _, in := range bval {
-		v := in.(int64)
+		v, ok := in.(int64)
+		if !ok || v < 0 || v > math.MaxUint8 {
+			return "", &ErrInvalidType{Value: in, Want: "byte"}
+		}
 		bites = append(bites, byte(v))
 	}
 	return string(bites), nil
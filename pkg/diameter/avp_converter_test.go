@@ -0,0 +1,111 @@
+package diameter
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+func TestConverters(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		converter func(interface{}) (datatype.Type, error)
+		input     interface{}
+		want      datatype.Type
+	}{
+		{"UTF8String", toUTF8String, "imsi", datatype.UTF8String("imsi")},
+		{"UTF8String from bytes", toUTF8String, []interface{}{int64(0x61), int64(0x62)}, datatype.UTF8String("ab")},
+		{"OctetString", toOctetString, "\x01\x02", datatype.OctetString("\x01\x02")},
+		{"OctetString from ArrayBuffer", toOctetString, []byte{1, 2}, datatype.OctetString("\x01\x02")},
+		{"Enumerated", toEnumerated, int64(1), datatype.Enumerated(1)},
+		{"Integer32 min", toInteger32, int64(math.MinInt32), datatype.Integer32(math.MinInt32)},
+		{"Integer64", toInteger64, int64(-1), datatype.Integer64(-1)},
+		{"Integer64 from BigInt", toInteger64, big.NewInt(math.MaxInt64), datatype.Integer64(math.MaxInt64)},
+		{"Unsigned32 max", toUnsigned32, int64(math.MaxUint32), datatype.Unsigned32(math.MaxUint32)},
+		{"Unsigned64 from BigInt", toUnsigned64, new(big.Int).SetUint64(math.MaxUint64), datatype.Unsigned64(math.MaxUint64)},
+		{"Float32 from integer", toFloat32, int64(2), datatype.Float32(2)},
+		{"Float64", toFloat64, 1.5, datatype.Float64(1.5)},
+		{"DiameterIdentity", toDiameterIdentity, "hss.example.com", datatype.DiameterIdentity("hss.example.com")},
+		{"Address IPv4", toAddress, "127.0.0.1", datatype.Address{127, 0, 0, 1}},
+		{"IPv4", toIPv4, "10.0.0.1", datatype.IPv4{10, 0, 0, 1}},
+		{"IPv6", toIPv6, "2001:db8::1", datatype.IPv6{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"IPv6Prefix", toIPv6Prefix, "2001:db8::/32", datatype.OctetString("\x00\x20\x20\x01\x0d\xb8")},
+		{"IPv6Prefix unaligned", toIPv6Prefix, "2001:db8:ff00::/36", datatype.OctetString("\x00\x24\x20\x01\x0d\xb8\xf0")},
+		{"Time", toTime, "2024-01-02T03:04:05Z", datatype.Time(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := tt.converter(tt.input)
+			if err != nil {
+				t.Fatalf("converter(%v) error = %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("converter(%v) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertersInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		converter func(interface{}) (datatype.Type, error)
+		input     interface{}
+	}{
+		{"UTF8String from number", toUTF8String, int64(1)},
+		{"UTF8String from out of range byte", toUTF8String, []interface{}{int64(256)}},
+		{"Integer32 overflow", toInteger32, int64(math.MaxInt32 + 1)},
+		{"Integer32 from float", toInteger32, 1.5},
+		{"Integer64 from BigInt overflow", toInteger64, new(big.Int).SetUint64(math.MaxUint64)},
+		{"Unsigned32 negative", toUnsigned32, int64(-1)},
+		{"Unsigned64 negative", toUnsigned64, int64(-1)},
+		{"Float64 from string", toFloat64, "1.5"},
+		{"Address", toAddress, "example.com"},
+		{"IPv4 from IPv6", toIPv4, "2001:db8::1"},
+		{"IPv6 from IPv4", toIPv6, "10.0.0.1"},
+		{"IPv6Prefix from IPv4", toIPv6Prefix, "10.0.0.0/8"},
+		{"IPv6Prefix without length", toIPv6Prefix, "2001:db8::"},
+		{"Time", toTime, "2024-01-02"},
+		{"Grouped from object", toGrouped, map[string]interface{}{}},
+		{"Grouped member without value", toGrouped, []interface{}{map[string]interface{}{"key": "User-Name"}}},
+		{"Grouped unknown member", toGrouped, []interface{}{map[string]interface{}{"key": "No-Such-AVP", "value": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got, err := tt.converter(tt.input); err == nil {
+				t.Errorf("converter(%v) = %#v, want error", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestToGrouped(t *testing.T) {
+	t.Parallel()
+
+	got, err := toGrouped([]interface{}{
+		map[string]interface{}{"key": "Number-Of-Requested-Vectors", "value": int64(3)},
+		map[string]interface{}{"key": "Immediate-Response-Preferred", "value": int64(0)},
+	})
+	if err != nil {
+		t.Fatalf("toGrouped() error = %v", err)
+	}
+	tree, _ := decodeAVPs(diam.TGPP_S6A_APP_ID, got.(*diam.GroupedAVP).AVP)
+	want := map[string]interface{}{
+		"Number-Of-Requested-Vectors":  uint32(3),
+		"Immediate-Response-Preferred": uint32(0),
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("toGrouped() members = %v, want %v", tree, want)
+	}
+}
@@ -0,0 +1,191 @@
+package diameter
+
+import (
+	"encoding/hex"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// DecodedAVP is an AVP of a received message together with its header
+// fields. Members holds the decoded members of a Grouped AVP.
+type DecodedAVP struct {
+	Name     string
+	Code     uint32
+	VendorId uint32
+	Flags    uint8
+	Value    interface{}
+	Members  []*DecodedAVP
+}
+
+// decodeAVPs decodes avps into a tree keyed by AVP name, where AVPs that
+// occur more than once become arrays and Grouped AVPs become nested trees,
+// and into the ordered list of the AVPs with their header fields.
+func decodeAVPs(appID uint32, avps []*diam.AVP) (map[string]interface{}, []*DecodedAVP) {
+	tree := make(map[string]interface{}, len(avps))
+	list := make([]*DecodedAVP, 0, len(avps))
+	for _, a := range avps {
+		d := &DecodedAVP{
+			Name:     avpName(appID, a),
+			Code:     a.Code,
+			VendorId: a.VendorID,
+			Flags:    a.Flags,
+		}
+		group, grouped := a.Data.(*diam.GroupedAVP)
+		switch {
+		case a.Data == nil:
+		case grouped:
+			d.Value, d.Members = decodeAVPs(appID, group.AVP)
+		case isIPv6PrefixAVP(a):
+			d.Value = decodeIPv6Prefix(a.Data)
+		default:
+			d.Value = decodeValue(a.Data)
+		}
+		list = append(list, d)
+
+		switch prev := tree[d.Name].(type) {
+		case nil:
+			tree[d.Name] = d.Value
+		case []interface{}:
+			tree[d.Name] = append(prev, d.Value)
+		default:
+			tree[d.Name] = []interface{}{prev, d.Value}
+		}
+	}
+	return tree, list
+}
+
+func avpName(appID uint32, a *diam.AVP) string {
+	def, err := dict.Default.FindAVPWithVendor(appID, a.Code, a.VendorID)
+	if err == nil && def.Data.Type != datatype.UnknownType {
+		return def.Name
+	}
+	// AVPs defined by another application than the message's
+	if name, ok := avpNameByCode(a.Code, a.VendorID); ok {
+		return name
+	}
+	return dict.MakeUnknownAVP(appID, a.Code, a.VendorID).Name
+}
+
+type avpKey struct {
+	code   uint32
+	vendor uint32
+}
+
+// avpNames are the names of the AVPs of all the applications of
+// dict.Default by code and vendor, built on first use and reset when a
+// dictionary is loaded.
+var avpNames struct {
+	sync.Mutex
+	byKey map[avpKey]string
+}
+
+// avpNameByCode returns the name of the AVP code of vendor in any
+// application.
+func avpNameByCode(code, vendor uint32) (string, bool) {
+	avpNames.Lock()
+	defer avpNames.Unlock()
+	if avpNames.byKey == nil {
+		avpNames.byKey = make(map[avpKey]string)
+		for _, app := range dict.Default.Apps() {
+			for _, def := range app.AVP {
+				key := avpKey{code: def.Code, vendor: def.VendorID}
+				if _, ok := avpNames.byKey[key]; !ok {
+					avpNames.byKey[key] = def.Name
+				}
+			}
+		}
+	}
+	name, ok := avpNames.byKey[avpKey{code: code, vendor: vendor}]
+	return name, ok
+}
+
+// resetAVPNames drops the AVP names cached by avpNameByCode.
+func resetAVPNames() {
+	avpNames.Lock()
+	defer avpNames.Unlock()
+	avpNames.byKey = nil
+}
+
+// maxSafeInteger is the largest integer a JS number holds exactly. 64 bit
+// values beyond it are handed to scripts as BigInts.
+const maxSafeInteger = 1<<53 - 1
+
+// decodeValue converts v to the value handed to scripts. Binary types are
+// returned as hex strings and addresses in their textual form.
+func decodeValue(v datatype.Type) interface{} {
+	switch val := v.(type) {
+	case datatype.UTF8String:
+		return string(val)
+	case datatype.DiameterIdentity:
+		return string(val)
+	case datatype.DiameterURI:
+		return string(val)
+	case datatype.IPFilterRule:
+		return string(val)
+	case datatype.QoSFilterRule:
+		return string(val)
+	case datatype.OctetString:
+		return hex.EncodeToString([]byte(val))
+	case datatype.Enumerated:
+		return int32(val)
+	case datatype.Integer32:
+		return int32(val)
+	case datatype.Integer64:
+		if val > maxSafeInteger || val < -maxSafeInteger {
+			return big.NewInt(int64(val))
+		}
+		return int64(val)
+	case datatype.Unsigned32:
+		return uint32(val)
+	case datatype.Unsigned64:
+		if val > maxSafeInteger {
+			return new(big.Int).SetUint64(uint64(val))
+		}
+		return uint64(val)
+	case datatype.Float32:
+		return float32(val)
+	case datatype.Float64:
+		return float64(val)
+	case datatype.Address:
+		if len(val) == net.IPv4len || len(val) == net.IPv6len {
+			return net.IP(val).String()
+		}
+		// Non-IP families, e.g. E.164, keep their 2 byte family prefix.
+		if len(val) > 2 {
+			return string(val[2:])
+		}
+		return hex.EncodeToString(val)
+	case datatype.IPv4:
+		return net.IP(val).String()
+	case datatype.IPv6:
+		return net.IP(val).String()
+	case datatype.Time:
+		return time.Time(val).UTC().Format(time.RFC3339)
+	case nil:
+		return nil
+	default:
+		return hex.EncodeToString(v.Serialize())
+	}
+}
+
+func isIPv6PrefixAVP(a *diam.AVP) bool {
+	return a.VendorID == 0 && (a.Code == avp.FramedIPv6Prefix || a.Code == avpDelegatedIPv6Prefix)
+}
+
+// decodeIPv6Prefix decodes an RFC 3162 prefix to the "2001:db8::/64" form.
+func decodeIPv6Prefix(v datatype.Type) interface{} {
+	b, ok := v.(datatype.OctetString)
+	if !ok || len(b) < 2 || int(b[1]) > 8*net.IPv6len || len(b)-2 > net.IPv6len {
+		return decodeValue(v)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, b[2:])
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(int(b[1]), 8*net.IPv6len)}).String()
+}
@@ -0,0 +1,120 @@
+package diameter
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+func TestDecodeValue(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input datatype.Type
+		want  interface{}
+	}{
+		{"UTF8String", datatype.UTF8String("imsi"), "imsi"},
+		{"OctetString", datatype.OctetString("\x01\xff"), "01ff"},
+		{"Enumerated", datatype.Enumerated(1), int32(1)},
+		{"Integer64 safe", datatype.Integer64(-maxSafeInteger), int64(-maxSafeInteger)},
+		{"Integer64 beyond safe", datatype.Integer64(math.MinInt64), big.NewInt(math.MinInt64)},
+		{"Unsigned64 safe", datatype.Unsigned64(maxSafeInteger), uint64(maxSafeInteger)},
+		{"Unsigned64 beyond safe", datatype.Unsigned64(math.MaxUint64), new(big.Int).SetUint64(math.MaxUint64)},
+		{"Address IPv4", datatype.Address{10, 0, 0, 1}, "10.0.0.1"},
+		{"Address E.164", datatype.Address("\x00\x08123"), "123"},
+		{"IPv6", datatype.IPv6{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "2001:db8::1"},
+		{"Time", datatype.Time(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)), "2024-01-02T03:04:05Z"},
+		{"nil", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := decodeValue(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeValue(%#v) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIPv6Prefix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input datatype.Type
+		want  interface{}
+	}{
+		{"prefix", datatype.OctetString("\x00\x20\x20\x01\x0d\xb8"), "2001:db8::/32"},
+		{"host", datatype.OctetString("\x00\x80\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"), "2001:db8::1/128"},
+		{"too long", datatype.OctetString("\x00\x81"), "0081"},
+		{"truncated", datatype.OctetString("\x00"), "00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := decodeIPv6Prefix(tt.input); got != tt.want {
+				t.Errorf("decodeIPv6Prefix(%#v) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeAVPs(t *testing.T) {
+	t.Parallel()
+
+	avps := []*diam.AVP{
+		diam.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("hss.example.com")),
+		diam.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address{10, 0, 0, 1}),
+		diam.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address{10, 0, 0, 2}),
+		diam.NewAVP(avp.FramedIPv6Prefix, avp.Mbit, 0, datatype.OctetString("\x00\x20\x20\x01\x0d\xb8")),
+		diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(vendorId3GPP)),
+			diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.TGPP_S6A_APP_ID)),
+		}}),
+	}
+	tree, list := decodeAVPs(diam.TGPP_S6A_APP_ID, avps)
+
+	want := map[string]interface{}{
+		"Origin-Host":        "hss.example.com",
+		"Host-IP-Address":    []interface{}{"10.0.0.1", "10.0.0.2"},
+		"Framed-IPv6-Prefix": "2001:db8::/32",
+		"Vendor-Specific-Application-Id": map[string]interface{}{
+			"Vendor-Id":           uint32(vendorId3GPP),
+			"Auth-Application-Id": uint32(diam.TGPP_S6A_APP_ID),
+		},
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("decodeAVPs() tree = %v, want %v", tree, want)
+	}
+	if len(list) != len(avps) {
+		t.Fatalf("decodeAVPs() list has %d AVPs, want %d", len(list), len(avps))
+	}
+	vsa := list[4]
+	if vsa.Code != avp.VendorSpecificApplicationID || vsa.Flags != avp.Mbit || len(vsa.Members) != 2 {
+		t.Errorf("decodeAVPs() list[4] = %+v", vsa)
+	}
+	if m := vsa.Members[1]; m.Name != "Auth-Application-Id" || m.Value != uint32(diam.TGPP_S6A_APP_ID) {
+		t.Errorf("decodeAVPs() list[4].Members[1] = %+v", m)
+	}
+}
+
+func TestDecodeAVPsUnknown(t *testing.T) {
+	t.Parallel()
+
+	tree, list := decodeAVPs(0, []*diam.AVP{
+		diam.NewAVP(65000, 0, 0, datatype.OctetString("\x01")),
+	})
+	if len(list) != 1 || list[0].Code != 65000 || list[0].Value != "01" {
+		t.Fatalf("decodeAVPs() list = %+v", list)
+	}
+	if got := tree[list[0].Name]; got != "01" {
+		t.Errorf("decodeAVPs() tree[%q] = %v, want 01", list[0].Name, got)
+	}
+}
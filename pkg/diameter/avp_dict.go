@@ -1,15 +1,30 @@
 package diameter
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+var (
+	avpDict   map[string]*AVPMetaC
+	avpDictMu sync.RWMutex
 )
 
-var avpDict map[string]*AVPMetaC
+const (
+	vendorId3GPP = 10415
 
-const vendorId3GPP = 10415
+	// RFC 4818
+	avpDelegatedIPv6Prefix = 123
+
+	// TS 29.272, missing from the go-diameter dictionary
+	avpIDAFlags = 1441
+)
 
 func init() {
-	// TODO: generate this part from XML dictionary files
 	avpDict = map[string]*AVPMetaC{
 		"User-Name":                            {code: avp.UserName, flag: avp.Mbit, vendor: 0, converter: toUTF8String},
 		"Auth-Session-State":                   {code: avp.AuthSessionState, flag: avp.Mbit, vendor: 0, converter: toEnumerated},
@@ -22,5 +37,110 @@ func init() {
 		"Terminal-Information":                 {code: avp.TerminalInformation, flag: avp.Vbit | avp.Mbit, vendor: vendorId3GPP, converter: toGrouped},
 		"IMEI":                                 {code: avp.IMEI, flag: avp.Vbit | avp.Mbit, vendor: vendorId3GPP, converter: toUTF8String},
 		"Software-Version":                     {code: avp.SoftwareVersion, flag: avp.Vbit | avp.Mbit, vendor: vendorId3GPP, converter: toUTF8String},
+		"IDA-Flags":                            {code: avpIDAFlags, flag: avp.Vbit | avp.Mbit, vendor: vendorId3GPP, converter: toUnsigned32},
+		// IPv6 prefixes are OctetStrings in the dictionaries
+		"Framed-IPv6-Prefix":    {code: avp.FramedIPv6Prefix, flag: avp.Mbit, vendor: 0, converter: toIPv6Prefix},
+		"Delegated-IPv6-Prefix": {code: avpDelegatedIPv6Prefix, flag: avp.Mbit, vendor: 0, converter: toIPv6Prefix},
+	}
+	// The built-in dictionaries register their AVPs in avpDict.
+	if err := loadDictionary("cx.xml", cxDictionary); err != nil {
+		panic(err)
+	}
+}
+
+// lookupAVP returns the encoding metadata of the AVP called name. AVPs that
+// are not in avpDict are resolved from the loaded dictionaries and cached.
+func lookupAVP(name string) (*AVPMetaC, error) {
+	avpDictMu.RLock()
+	meta, ok := avpDict[name]
+	avpDictMu.RUnlock()
+	if ok {
+		return meta, nil
+	}
+
+	def, err := dict.Default.FindAVP(0, name)
+	if err != nil {
+		if def, err = dict.Default.ScanAVP(name); err != nil {
+			return nil, &ErrNotFound{name}
+		}
+	}
+	if meta, err = newAVPMeta(def); err != nil {
+		return nil, err
+	}
+	registerAVP(name, meta)
+	return meta, nil
+}
+
+func registerAVP(name string, meta *AVPMetaC) {
+	avpDictMu.Lock()
+	defer avpDictMu.Unlock()
+	avpDict[name] = meta
+}
+
+// newAVPMeta returns the encoding metadata of a dictionary AVP definition.
+func newAVPMeta(def *dict.AVP) (*AVPMetaC, error) {
+	converter := converterFor(def.Data.Type)
+	if converter == nil {
+		return nil, &ErrUnsupportedType{Name: def.Name, Type: def.Data.TypeName}
+	}
+	return &AVPMetaC{
+		code:      def.Code,
+		flag:      avpFlags(def),
+		vendor:    def.VendorID,
+		converter: converter,
+	}, nil
+}
+
+// avpFlags returns the flags an AVP definition requires to be set.
+func avpFlags(def *dict.AVP) uint8 {
+	var flag uint8
+	if strings.Contains(def.Must, "M") {
+		flag |= avp.Mbit
+	}
+	if strings.Contains(def.Must, "V") || def.VendorID != 0 {
+		flag |= avp.Vbit
+	}
+	return flag
+}
+
+func converterFor(t datatype.TypeID) func(interface{}) (datatype.Type, error) {
+	switch t {
+	case datatype.UTF8StringType:
+		return toUTF8String
+	case datatype.OctetStringType:
+		return toOctetString
+	case datatype.EnumeratedType:
+		return toEnumerated
+	case datatype.Integer32Type:
+		return toInteger32
+	case datatype.Integer64Type:
+		return toInteger64
+	case datatype.Unsigned32Type:
+		return toUnsigned32
+	case datatype.Unsigned64Type:
+		return toUnsigned64
+	case datatype.Float32Type:
+		return toFloat32
+	case datatype.Float64Type:
+		return toFloat64
+	case datatype.AddressType:
+		return toAddress
+	case datatype.IPv4Type:
+		return toIPv4
+	case datatype.IPv6Type:
+		return toIPv6
+	case datatype.TimeType:
+		return toTime
+	case datatype.DiameterIdentityType:
+		return toDiameterIdentity
+	case datatype.DiameterURIType:
+		return toDiameterURI
+	case datatype.IPFilterRuleType:
+		return toIPFilterRule
+	case datatype.QoSFilterRuleType:
+		return toQoSFilterRule
+	case datatype.GroupedType:
+		return toGrouped
 	}
+	return nil
 }
@@ -24,5 +24,38 @@ type ErrInvalidType struct {
 }
 
 func (e *ErrInvalidType) Error() string {
-	return fmt.Sprintf("invalid type(%v): want: %s, got: %s", e.Value, e.Want, e.Value)
+	return fmt.Sprintf("invalid type(%v): want: %s, got: %T", e.Value, e.Want, e.Value)
+}
+
+// ErrAVP is an error encoding the AVP at Path, the names of the AVP and of
+// the Grouped AVPs it is in, e.g. `Subscription-Data.AMBR`.
+type ErrAVP struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrAVP) Error() string {
+	return fmt.Sprintf("avp `%s`: %v", e.Path, e.Err)
+}
+
+func (e *ErrAVP) Unwrap() error {
+	return e.Err
+}
+
+// withAVPPath returns err as an error encoding the AVP name, or a member of
+// it when err already is an ErrAVP.
+func withAVPPath(name string, err error) error {
+	if e, ok := err.(*ErrAVP); ok {
+		return &ErrAVP{Path: name + "." + e.Path, Err: e.Err}
+	}
+	return &ErrAVP{Path: name, Err: err}
+}
+
+type ErrUnsupportedType struct {
+	Name string
+	Type string
+}
+
+func (e *ErrUnsupportedType) Error() string {
+	return fmt.Sprintf("unsupported type `%s` of `%s`", e.Type, e.Name)
 }
@@ -0,0 +1,305 @@
+package diameter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+// relayAppId is the Relay application id, which matches any application.
+const relayAppId = 0xffffffff
+
+// cerRetransmitInterval is the time waited for a CEA before sending the CER
+// again.
+const cerRetransmitInterval = time.Second
+
+var errCERTimeout = errors.New("capabilities exchange timeout (no CEA)")
+
+// ErrNoCommonApplication is returned by Connect when the CEA of the peer
+// succeeds but none of its applications is one the client advertised.
+var ErrNoCommonApplication = errors.New("no common application with the peer")
+
+// ErrCEARejected is returned by Connect when the peer answers the CER with
+// an error, e.g. 5010 DIAMETER_NO_COMMON_APPLICATION.
+type ErrCEARejected struct {
+	Addr         string
+	ResultCode   uint32
+	ErrorMessage string
+}
+
+func (e *ErrCEARejected) Error() string {
+	msg := fmt.Sprintf("capabilities exchange with %s rejected with Result-Code %d", e.Addr, e.ResultCode)
+	if e.ErrorMessage != "" {
+		msg += ": " + e.ErrorMessage
+	}
+	return msg
+}
+
+// ApplicationOptions is an application advertised in the capabilities
+// exchange. Applications with a VendorId are advertised in a
+// Vendor-Specific-Application-Id, the others in a plain Auth-Application-Id
+// or, when Acct is set, Acct-Application-Id.
+type ApplicationOptions struct {
+	AppId    uint
+	VendorId uint
+	Acct     bool
+}
+
+// CapabilitiesExchange is the outcome of the capabilities exchange: the
+// CEA of the peer and the applications both ends support.
+type CapabilitiesExchange struct {
+	ResultCode         uint32
+	OriginHost         string
+	OriginRealm        string
+	ProductName        string
+	VendorId           uint32
+	HostIPAddresses    []string
+	InbandSecurityId   uint32
+	Applications       []ApplicationOptions
+	CommonApplications []uint32
+	Avps               map[string]interface{}
+	AvpList            []*DecodedAVP
+}
+
+// applications returns the applications to advertise, defaulting to the
+// vendor-specific AppId of VendorId.
+func (co ConnectionOptions) applications() []ApplicationOptions {
+	if len(co.Applications) > 0 {
+		return co.Applications
+	}
+	return []ApplicationOptions{{AppId: co.AppId, VendorId: co.VendorId}}
+}
+
+// supportedVendorIds returns the vendors to advertise, defaulting to VendorId
+// and the vendors of the applications.
+func (co ConnectionOptions) supportedVendorIds() []uint {
+	if len(co.SupportedVendorIds) > 0 {
+		return co.SupportedVendorIds
+	}
+	vendors := []uint{co.VendorId}
+	for _, app := range co.applications() {
+		if app.VendorId != 0 && !containsUint(vendors, app.VendorId) {
+			vendors = append(vendors, app.VendorId)
+		}
+	}
+	return vendors
+}
+
+func containsUint(s []uint, v uint) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// newCER builds the Capabilities-Exchange-Request sent from the local
+// address.
+func (c *K6DiameterClient) newCER(local net.Addr) *diam.Message {
+	options := c.options
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, c.cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, c.cfg.OriginRealm)
+	hostIPAddresses := c.cfg.HostIPAddresses
+	if len(hostIPAddresses) == 0 {
+		hostIPAddresses = localAddresses(local)
+	}
+	for _, addr := range hostIPAddresses {
+		m.NewAVP(avp.HostIPAddress, avp.Mbit, 0, addr)
+	}
+	m.NewAVP(avp.VendorID, avp.Mbit, 0, c.cfg.VendorID)
+	m.NewAVP(avp.ProductName, 0, 0, c.cfg.ProductName)
+	m.NewAVP(avp.OriginStateID, avp.Mbit, 0, c.cfg.OriginStateID)
+	for _, vendor := range options.supportedVendorIds() {
+		m.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(vendor))
+	}
+	for _, app := range options.applications() {
+		code := uint32(avp.AuthApplicationID)
+		if app.Acct {
+			code = avp.AcctApplicationID
+		}
+		if app.VendorId == 0 {
+			m.NewAVP(code, avp.Mbit, 0, datatype.Unsigned32(app.AppId))
+			continue
+		}
+		m.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(app.VendorId)),
+				diam.NewAVP(code, avp.Mbit, 0, datatype.Unsigned32(app.AppId)),
+			},
+		})
+	}
+	if options.InbandSecurityId == inbandSecurityTLS {
+		m.NewAVP(avp.InbandSecurityID, avp.Mbit, 0, datatype.Unsigned32(options.InbandSecurityId))
+	}
+	m.NewAVP(avp.FirmwareRevision, 0, 0, c.cfg.FirmwareRevision)
+	return m
+}
+
+// localAddresses returns the IP addresses of local, which are advertised
+// when no Host-IP-Address is configured.
+func localAddresses(local net.Addr) []datatype.Address {
+	if local == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return nil
+	}
+	// SCTP associations list their addresses separated by slashes
+	var addrs []datatype.Address
+	for _, s := range strings.Split(host, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			addrs = append(addrs, datatype.Address(ip))
+		}
+	}
+	return addrs
+}
+
+// exchangeCapabilities sends the CER to the peer at addr, retransmitting it
+// up to Retries times, and waits for the CEA on ceac, or for the error of
+// reading it on errc. Before an in-band TLS upgrade the CER is not
+// retransmitted, so that no second CEA follows the first in the clear.
+func (c *K6DiameterClient) exchangeCapabilities(conn io.Writer, local net.Addr, addr string, ceac <-chan *diam.Message, errc <-chan error) (*CapabilitiesExchange, error) {
+	m := c.newCER(local)
+	retransmit := c.options.InbandSecurityId != inbandSecurityTLS
+	for i := 0; i <= int(c.options.Retries); i++ {
+		if i == 0 || retransmit {
+			if _, err := m.WriteTo(conn); err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case a := <-ceac:
+			return c.checkCEA(addr, a)
+		case err := <-errc:
+			return nil, err
+		case <-time.After(cerRetransmitInterval):
+		}
+	}
+	return nil, errCERTimeout
+}
+
+// checkCEA checks the CEA a of the peer at addr.
+func (c *K6DiameterClient) checkCEA(addr string, a *diam.Message) (*CapabilitiesExchange, error) {
+	cea := newCapabilitiesExchange(a, c.options.applications())
+	if !isSuccess(cea.ResultCode) {
+		errorMessage, _ := cea.Avps["Error-Message"].(string)
+		return cea, &ErrCEARejected{
+			Addr:         addr,
+			ResultCode:   cea.ResultCode,
+			ErrorMessage: errorMessage,
+		}
+	}
+	if cea.OriginHost == "" || cea.OriginRealm == "" {
+		return cea, errors.New("CEA without Origin-Host or Origin-Realm")
+	}
+	if len(cea.CommonApplications) == 0 {
+		return cea, ErrNoCommonApplication
+	}
+	return cea, nil
+}
+
+// setPeerMetadata keeps the peer metadata of cea in the context of conn.
+func setPeerMetadata(conn diam.Conn, cea *CapabilitiesExchange) {
+	meta := &smpeer.Metadata{
+		OriginHost:   datatype.DiameterIdentity(cea.OriginHost),
+		OriginRealm:  datatype.DiameterIdentity(cea.OriginRealm),
+		Applications: cea.CommonApplications,
+	}
+	conn.SetContext(smpeer.NewContext(conn.Context(), meta))
+}
+
+func newCapabilitiesExchange(m *diam.Message, local []ApplicationOptions) *CapabilitiesExchange {
+	cea := &CapabilitiesExchange{}
+	cea.ResultCode, _ = resultCodes(m)
+	cea.Avps, cea.AvpList = decodeAVPs(0, m.AVP)
+	for _, a := range m.AVP {
+		switch a.Code {
+		case avp.OriginHost:
+			cea.OriginHost = datatypeString(a.Data)
+		case avp.OriginRealm:
+			cea.OriginRealm = datatypeString(a.Data)
+		case avp.ProductName:
+			cea.ProductName = datatypeString(a.Data)
+		case avp.HostIPAddress:
+			cea.HostIPAddresses = append(cea.HostIPAddresses, datatypeString(a.Data))
+		case avp.VendorID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				cea.VendorId = uint32(v)
+			}
+		case avp.InbandSecurityID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				cea.InbandSecurityId = uint32(v)
+			}
+		case avp.AuthApplicationID, avp.AcctApplicationID:
+			if app, ok := peerApplication(a, 0); ok {
+				cea.Applications = append(cea.Applications, app)
+			}
+		case avp.VendorSpecificApplicationID:
+			group, ok := a.Data.(*diam.GroupedAVP)
+			if !ok {
+				continue
+			}
+			var vendor uint
+			for _, member := range group.AVP {
+				if v, ok := member.Data.(datatype.Unsigned32); ok && member.Code == avp.VendorID {
+					vendor = uint(v)
+				}
+			}
+			for _, member := range group.AVP {
+				if app, ok := peerApplication(member, vendor); ok {
+					cea.Applications = append(cea.Applications, app)
+				}
+			}
+		}
+	}
+	cea.CommonApplications = commonApplications(local, cea.Applications)
+	return cea
+}
+
+func peerApplication(a *diam.AVP, vendor uint) (ApplicationOptions, bool) {
+	id, ok := a.Data.(datatype.Unsigned32)
+	if !ok || a.Code != avp.AuthApplicationID && a.Code != avp.AcctApplicationID {
+		return ApplicationOptions{}, false
+	}
+	return ApplicationOptions{
+		AppId:    uint(id),
+		VendorId: vendor,
+		Acct:     a.Code == avp.AcctApplicationID,
+	}, true
+}
+
+// commonApplications returns the ids of the local applications the peer
+// supports, or relays.
+func commonApplications(local, peer []ApplicationOptions) []uint32 {
+	common := []uint32{}
+	for _, l := range local {
+		for _, p := range peer {
+			if (p.AppId == l.AppId || p.AppId == relayAppId) && p.Acct == l.Acct {
+				common = append(common, uint32(l.AppId))
+				break
+			}
+		}
+	}
+	return common
+}
+
+func datatypeString(v datatype.Type) string {
+	s, _ := decodeValue(v).(string)
+	return s
+}
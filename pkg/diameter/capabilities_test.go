@@ -0,0 +1,147 @@
+package diameter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+func TestCommonApplications(t *testing.T) {
+	t.Parallel()
+
+	s6a := ApplicationOptions{AppId: diam.TGPP_S6A_APP_ID, VendorId: vendorId3GPP}
+	gx := ApplicationOptions{AppId: diam.GX_CHARGING_CONTROL_APP_ID, VendorId: vendorId3GPP}
+	tests := []struct {
+		name  string
+		local []ApplicationOptions
+		peer  []ApplicationOptions
+		want  []uint32
+	}{
+		{
+			name:  "same",
+			local: []ApplicationOptions{s6a},
+			peer:  []ApplicationOptions{s6a},
+			want:  []uint32{diam.TGPP_S6A_APP_ID},
+		},
+		{
+			name:  "subset in local order",
+			local: []ApplicationOptions{gx, s6a},
+			peer:  []ApplicationOptions{s6a, gx},
+			want:  []uint32{diam.GX_CHARGING_CONTROL_APP_ID, diam.TGPP_S6A_APP_ID},
+		},
+		{
+			name:  "vendor of the peer ignored",
+			local: []ApplicationOptions{s6a},
+			peer:  []ApplicationOptions{{AppId: diam.TGPP_S6A_APP_ID}},
+			want:  []uint32{diam.TGPP_S6A_APP_ID},
+		},
+		{
+			name:  "relay",
+			local: []ApplicationOptions{s6a, gx},
+			peer:  []ApplicationOptions{{AppId: relayAppId}},
+			want:  []uint32{diam.TGPP_S6A_APP_ID, diam.GX_CHARGING_CONTROL_APP_ID},
+		},
+		{
+			name:  "auth and acct differ",
+			local: []ApplicationOptions{{AppId: 3, Acct: true}},
+			peer:  []ApplicationOptions{{AppId: 3}},
+			want:  []uint32{},
+		},
+		{
+			name:  "none",
+			local: []ApplicationOptions{s6a},
+			peer:  []ApplicationOptions{gx},
+			want:  []uint32{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := commonApplications(tt.local, tt.peer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commonApplications() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestCEA(resultCode uint32, avps ...*diam.AVP) *diam.Message {
+	cer := diam.NewRequest(diam.CapabilitiesExchange, 0, dict.Default)
+	a := cer.Answer(resultCode)
+	for _, e := range avps {
+		a.AddAVP(e)
+	}
+	return a
+}
+
+func TestCheckCEA(t *testing.T) {
+	t.Parallel()
+
+	originHost := diam.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("hss.example.com"))
+	originRealm := diam.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+	s6a := diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(vendorId3GPP)),
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.TGPP_S6A_APP_ID)),
+	}})
+	gx := diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.GX_CHARGING_CONTROL_APP_ID))
+	errorMessage := diam.NewAVP(avp.ErrorMessage, 0, 0, datatype.UTF8String("no common application"))
+
+	tests := []struct {
+		name       string
+		cea        *diam.Message
+		wantErr    error
+		wantCommon []uint32
+	}{
+		{
+			name:       "success",
+			cea:        newTestCEA(diam.Success, originHost, originRealm, s6a),
+			wantCommon: []uint32{diam.TGPP_S6A_APP_ID},
+		},
+		{
+			name: "rejected",
+			cea:  newTestCEA(diam.NoCommonApplication, originHost, originRealm, errorMessage),
+			wantErr: &ErrCEARejected{
+				Addr:         "hss:3868",
+				ResultCode:   diam.NoCommonApplication,
+				ErrorMessage: "no common application",
+			},
+		},
+		{
+			name:    "no common application",
+			cea:     newTestCEA(diam.Success, originHost, originRealm, gx),
+			wantErr: ErrNoCommonApplication,
+		},
+		{
+			name:    "no Origin-Realm",
+			cea:     newTestCEA(diam.Success, originHost, s6a),
+			wantErr: errors.New("CEA without Origin-Host or Origin-Realm"),
+		},
+	}
+	c := &K6DiameterClient{options: ConnectionOptions{AppId: diam.TGPP_S6A_APP_ID, VendorId: vendorId3GPP}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cea, err := c.checkCEA("hss:3868", tt.cea)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("checkCEA() error = %v", err)
+			case tt.wantErr != nil && (err == nil || err.Error() != tt.wantErr.Error()):
+				t.Fatalf("checkCEA() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == ErrNoCommonApplication && !errors.Is(err, ErrNoCommonApplication) {
+				t.Errorf("checkCEA() error = %v, want ErrNoCommonApplication", err)
+			}
+			var rejected *ErrCEARejected
+			if want, ok := tt.wantErr.(*ErrCEARejected); ok && (!errors.As(err, &rejected) || *rejected != *want) {
+				t.Errorf("checkCEA() error = %#v, want %#v", err, want)
+			}
+			if tt.wantCommon != nil && !reflect.DeepEqual(cea.CommonApplications, tt.wantCommon) {
+				t.Errorf("checkCEA() common applications = %v, want %v", cea.CommonApplications, tt.wantCommon)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package diameter
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// CC-Request-Type values (RFC 4006 section 8.3).
+const (
+	ccInitialRequest     = 1
+	ccUpdateRequest      = 2
+	ccTerminationRequest = 3
+)
+
+// terminationCauseLogout is the Termination-Cause of session terminations
+// unless set, DIAMETER_LOGOUT.
+const terminationCauseLogout = 1
+
+// subscriptionIDTypes are the Subscription-Id-Type values by the names
+// scripts use (RFC 4006 section 8.47).
+var subscriptionIDTypes = map[string]int64{
+	"e164":    0,
+	"imsi":    1,
+	"sip_uri": 2,
+	"nai":     3,
+	"private": 4,
+}
+
+// SubscriptionID identifies the subscriber. Type is one of e164, imsi,
+// sip_uri, nai and private.
+type SubscriptionID struct {
+	Type string
+	Data string
+}
+
+// subscriptionIDAVPs returns the Subscription-Id AVPs of ids, or of the IMSI
+// ueimsi without ids.
+func subscriptionIDAVPs(ids []SubscriptionID, ueimsi string) ([]AVP, error) {
+	if len(ids) == 0 && ueimsi != "" {
+		ids = []SubscriptionID{{Type: "imsi", Data: ueimsi}}
+	}
+	var avps []AVP
+	for _, id := range ids {
+		t, ok := subscriptionIDTypes[id.Type]
+		if !ok {
+			return nil, errors.Errorf("unknown subscription id type `%s`", id.Type)
+		}
+		avps = append(avps, AVP{Key: "Subscription-Id", Value: groupAVPs(
+			AVP{Key: "Subscription-Id-Type", Value: t},
+			AVP{Key: "Subscription-Id-Data", Value: id.Data},
+		)})
+	}
+	return avps, nil
+}
+
+// ccSession is a credit-control session (RFC 4006), which numbers its
+// requests with CC-Request-Number.
+type ccSession struct {
+	*session
+	number uint32
+}
+
+func newCCSession(c *K6DiameterClient, appID uint32, options ConnectionOptions) (*ccSession, error) {
+	s, err := newSession(c, appID, options)
+	if err != nil {
+		return nil, err
+	}
+	return &ccSession{session: s}, nil
+}
+
+// exchange sends the next request of the session, of type requestType,
+// with its Auth-Application-Id, CC-Request-Type and CC-Request-Number
+// followed by avps, and waits for its answer. The CC-Request-Number is used
+// up when the request is built, so that a request sent again after a
+// timeout has a new one.
+func (s *ccSession) exchange(requestType uint32, avps []AVP) (*diam.Message, error) {
+	request := sessionUpdate
+	switch requestType {
+	case ccInitialRequest:
+		request = sessionInitial
+	case ccTerminationRequest:
+		request = sessionTermination
+	}
+	return s.send(request, diam.CreditControl, func() (ConnectionOptions, error) {
+		number := s.number
+		s.number++
+		return s.request(append([]AVP{
+			{Key: "Auth-Application-Id", Value: int64(s.appID)},
+			{Key: "CC-Request-Type", Value: int64(requestType)},
+			{Key: "CC-Request-Number", Value: int64(number)},
+		}, avps...)), nil
+	})
+}
+
+// groupAVPs returns avps as the value of a Grouped AVP.
+func groupAVPs(avps ...AVP) []interface{} {
+	group := make([]interface{}, len(avps))
+	for i, a := range avps {
+		group[i] = map[string]interface{}{"key": a.Key, "value": a.Value}
+	}
+	return group
+}
+
+func groupMembers(a *diam.AVP) []*diam.AVP {
+	if group, ok := a.Data.(*diam.GroupedAVP); ok {
+		return group.AVP
+	}
+	return nil
+}
+
+// avpString returns the value of a string AVP. Unlike decodeValue, it
+// returns OctetStrings such as rule names as is.
+func avpString(a *diam.AVP) string {
+	switch v := a.Data.(type) {
+	case datatype.OctetString:
+		return string(v)
+	case datatype.UTF8String:
+		return string(v)
+	case datatype.IPFilterRule:
+		return string(v)
+	}
+	return ""
+}
+
+// avpUint returns the value of an integer AVP.
+func avpUint(a *diam.AVP) uint64 {
+	switch v := a.Data.(type) {
+	case datatype.Unsigned32:
+		return uint64(v)
+	case datatype.Unsigned64:
+		return uint64(v)
+	case datatype.Enumerated:
+		return uint64(v)
+	case datatype.Integer32:
+		return uint64(v)
+	case datatype.Integer64:
+		return uint64(v)
+	}
+	return 0
+}
+
+// initialIMSI returns ueimsi in initial requests, whose Subscription-Id it
+// is by default.
+func initialIMSI(requestType uint32, ueimsi string) string {
+	if requestType != ccInitialRequest {
+		return ""
+	}
+	return ueimsi
+}
@@ -0,0 +1,249 @@
+package diameter
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+)
+
+// testPeer is a peer answering the requests of a test.
+type testPeer struct {
+	addr string
+	mux  *sm.StateMachine
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mux := sm.New(&sm.Settings{
+		OriginHost:  "peer.example.com",
+		OriginRealm: "example.com",
+		ProductName: "test",
+	})
+	go diam.Serve(l, mux)
+	p := &testPeer{addr: l.Addr().String(), mux: mux}
+	p.handle(0, diam.DisconnectPeer, func(*diam.Message) uint32 { return diam.Success })
+	return p
+}
+
+// handle answers the requests code of appID with the Result-Code answer
+// returns, or not at all for 0.
+func (p *testPeer) handle(appID, code uint32, answer func(m *diam.Message) uint32) {
+	p.mux.HandleIdx(diam.CommandIndex{AppID: appID, Code: code, Request: true}, diam.HandlerFunc(func(c diam.Conn, m *diam.Message) {
+		resultCode := answer(m)
+		if resultCode == 0 {
+			return
+		}
+		a := m.Answer(resultCode)
+		if sid, err := m.FindAVP(avp.SessionID, 0); err == nil {
+			a.InsertAVP(sid)
+		}
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("peer.example.com"))
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+		a.WriteTo(c)
+	}))
+}
+
+// connect returns a client of appID connected to the peer.
+func (p *testPeer) connect(t *testing.T, appID uint32) *K6DiameterClient {
+	t.Helper()
+	c := &K6DiameterClient{}
+	_, err := c.connect(ConnectionOptions{
+		Addr:  p.addr,
+		Host:  "client.example.com",
+		Realm: "example.com",
+		AppId: uint(appID),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// ccRequest is a Credit-Control-Request received by a test peer.
+type ccRequest struct {
+	requestType uint32
+	number      uint32
+}
+
+func receivedCCRequest(m *diam.Message) ccRequest {
+	var r ccRequest
+	if a, err := m.FindAVP(avp.CCRequestType, 0); err == nil {
+		r.requestType = uint32(a.Data.(datatype.Enumerated))
+	}
+	if a, err := m.FindAVP(avp.CCRequestNumber, 0); err == nil {
+		r.number = uint32(a.Data.(datatype.Unsigned32))
+	}
+	return r
+}
+
+func TestCCSessionRequestNumber(t *testing.T) {
+	t.Parallel()
+
+	type step struct {
+		requestType uint32
+		resultCode  uint32 // 0 leaves the request unanswered
+		wantErr     bool
+		wantState   sessionState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []ccRequest
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				{requestType: ccInitialRequest, resultCode: diam.Success, wantState: sessionOpen},
+				{requestType: ccUpdateRequest, resultCode: diam.Success, wantState: sessionOpen},
+				{requestType: ccUpdateRequest, resultCode: diam.Success, wantState: sessionOpen},
+				{requestType: ccTerminationRequest, resultCode: diam.Success, wantState: sessionTerminated},
+			},
+			want: []ccRequest{
+				{ccInitialRequest, 0}, {ccUpdateRequest, 1}, {ccUpdateRequest, 2}, {ccTerminationRequest, 3},
+			},
+		},
+		{
+			name: "rejected initial",
+			steps: []step{
+				{requestType: ccInitialRequest, resultCode: diam.UnableToComply, wantState: sessionIdle},
+				{requestType: ccUpdateRequest, wantErr: true, wantState: sessionIdle},
+				{requestType: ccInitialRequest, resultCode: diam.Success, wantState: sessionOpen},
+			},
+			want: []ccRequest{
+				{ccInitialRequest, 0}, {ccInitialRequest, 1},
+			},
+		},
+		{
+			name: "unanswered update",
+			steps: []step{
+				{requestType: ccInitialRequest, resultCode: diam.Success, wantState: sessionOpen},
+				{requestType: ccUpdateRequest, wantErr: true, wantState: sessionOpen},
+				{requestType: ccUpdateRequest, resultCode: diam.Success, wantState: sessionOpen},
+			},
+			want: []ccRequest{
+				{ccInitialRequest, 0}, {ccUpdateRequest, 1}, {ccUpdateRequest, 2},
+			},
+		},
+		{
+			name: "rejected termination",
+			steps: []step{
+				{requestType: ccInitialRequest, resultCode: diam.Success, wantState: sessionOpen},
+				{requestType: ccTerminationRequest, resultCode: diam.UnableToComply, wantState: sessionOpen},
+				{requestType: ccTerminationRequest, resultCode: diam.Success, wantState: sessionTerminated},
+				{requestType: ccUpdateRequest, wantErr: true, wantState: sessionTerminated},
+			},
+			want: []ccRequest{
+				{ccInitialRequest, 0}, {ccTerminationRequest, 1}, {ccTerminationRequest, 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			peer := newTestPeer(t)
+			var (
+				mu         sync.Mutex
+				received   []ccRequest
+				resultCode uint32
+			)
+			peer.handle(diam.GX_CHARGING_CONTROL_APP_ID, diam.CreditControl, func(m *diam.Message) uint32 {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, receivedCCRequest(m))
+				return resultCode
+			})
+			c := peer.connect(t, diam.GX_CHARGING_CONTROL_APP_ID)
+			s, err := newCCSession(c, diam.GX_CHARGING_CONTROL_APP_ID, ConnectionOptions{CompletionSleep: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, step := range tt.steps {
+				mu.Lock()
+				resultCode = step.resultCode
+				mu.Unlock()
+				_, err := s.exchange(step.requestType, nil)
+				if (err != nil) != step.wantErr {
+					t.Fatalf("step %d: exchange() error = %v, wantErr %v", i, err, step.wantErr)
+				}
+				s.mu.Lock()
+				state := s.state
+				s.mu.Unlock()
+				if state != step.wantState {
+					t.Errorf("step %d: state = %d, want %d", i, state, step.wantState)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) != len(tt.want) {
+				t.Fatalf("peer received %v, want %v", received, tt.want)
+			}
+			for i := range tt.want {
+				if received[i] != tt.want[i] {
+					t.Errorf("request %d = %+v, want %+v", i, received[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCCSessionConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t)
+	var (
+		mu      sync.Mutex
+		numbers []uint32
+	)
+	peer.handle(diam.GX_CHARGING_CONTROL_APP_ID, diam.CreditControl, func(m *diam.Message) uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+		numbers = append(numbers, receivedCCRequest(m).number)
+		return diam.Success
+	})
+	c := peer.connect(t, diam.GX_CHARGING_CONTROL_APP_ID)
+	s, err := newCCSession(c, diam.GX_CHARGING_CONTROL_APP_ID, ConnectionOptions{CompletionSleep: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.exchange(ccInitialRequest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const updates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.exchange(ccUpdateRequest, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The requests are sent one at a time, so the peer receives them in
+	// the order of their numbers.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(numbers) != updates+1 {
+		t.Fatalf("peer received %d requests, want %d", len(numbers), updates+1)
+	}
+	for i, n := range numbers {
+		if n != uint32(i) {
+			t.Fatalf("peer received requests numbered %v, want 0 to %d in order", numbers, updates)
+		}
+	}
+}
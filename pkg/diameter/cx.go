@@ -0,0 +1,411 @@
+package diameter
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"sort"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+)
+
+// TS 29.229, missing from the go-diameter dictionary
+const (
+	cxAppID = 16777216
+
+	cmdUserAuthorization = 300
+	cmdLocationInfo      = 302
+	cmdPushProfile       = 305
+)
+
+// cxDictionary defines the Cx/Dx application, its commands and AVPs.
+//
+//go:embed dictionaries/cx.xml
+var cxDictionary []byte
+
+// defaultSIPAuthenticationScheme is the SIP-Authentication-Scheme of
+// Multimedia-Auth-Requests unless set, IMS AKA.
+const defaultSIPAuthenticationScheme = "Digest-AKAv1-MD5"
+
+// userAuthorizationTypes are the User-Authorization-Type values by the names
+// scripts use (TS 29.229 section 6.3.24).
+var userAuthorizationTypes = map[string]int64{
+	"registration":                  0,
+	"de_registration":               1,
+	"registration_and_capabilities": 2,
+}
+
+// serverAssignmentTypes are the Server-Assignment-Type values by the names
+// scripts use (TS 29.229 section 6.3.15).
+var serverAssignmentTypes = map[string]int64{
+	"no_assignment":                            0,
+	"registration":                             1,
+	"re_registration":                          2,
+	"unregistered_user":                        3,
+	"timeout_deregistration":                   4,
+	"user_deregistration":                      5,
+	"timeout_deregistration_store_server_name": 6,
+	"user_deregistration_store_server_name":    7,
+	"administrative_deregistration":            8,
+	"authentication_failure":                   9,
+	"authentication_timeout":                   10,
+	"deregistration_too_much_data":             11,
+	"aaa_user_data_request":                    12,
+	"pgw_update":                               13,
+	"restoration":                              14,
+}
+
+// CxRequestOptions describes a Cx request of the I-CSCF or S-CSCF to the
+// HSS: User-Authorization, Server-Assignment, Location-Info or
+// Multimedia-Auth.
+type CxRequestOptions struct {
+	ConnectionOptions
+
+	// PrivateIdentity is the IMPI, sent as User-Name.
+	PrivateIdentity string
+	// PublicIdentities are the IMPUs. Requests other than
+	// Server-Assignment carry only the first.
+	PublicIdentities         []string
+	VisitedNetworkIdentifier string
+	ServerName               string
+
+	// UserAuthorizationType is one of registration, de_registration and
+	// registration_and_capabilities.
+	UserAuthorizationType string
+	// ServerAssignmentType is one of the Server-Assignment-Type values in
+	// snake case, e.g. registration or user_deregistration.
+	ServerAssignmentType     string
+	UserDataAlreadyAvailable bool
+
+	// Originating sets Originating-Request in Location-Info-Requests.
+	Originating bool
+
+	// SipNumberAuthItems defaults to 1 and SipAuthDataItem to the
+	// Digest-AKAv1-MD5 scheme in Multimedia-Auth-Requests.
+	SipNumberAuthItems uint
+	SipAuthDataItem    *SIPAuthDataItem
+}
+
+// SIPAuthDataItem is a SIP-Auth-Data-Item. Its binary values are hex
+// strings: Authenticate is RAND and AUTN, Authorization the AUTS of a
+// resynchronization.
+type SIPAuthDataItem struct {
+	ItemNumber         uint
+	Scheme             string
+	Authenticate       string
+	Authorization      string
+	ConfidentialityKey string
+	IntegrityKey       string
+}
+
+// CxAnswer is the answer to a Cx request. AuthItems are the
+// SIP-Auth-Data-Items of a Multimedia-Auth-Answer and UserData the IMS
+// subscription of a Server-Assignment-Answer, or UserDataError why its
+// User-Data could not be decoded.
+type CxAnswer struct {
+	Answer
+	AuthItems     []*SIPAuthDataItem
+	UserData      *IMSSubscription
+	UserDataError string
+}
+
+// SendUAR sends a User-Authorization-Request without waiting for the answer.
+func (c *K6DiameterClient) SendUAR(v sobek.Value) (bool, error) {
+	return c.sendCx(cmdUserAuthorization, v)
+}
+
+// CheckSendUAR sends a User-Authorization-Request and returns the answer,
+// with the Server-Name or Server-Capabilities of the S-CSCF.
+func (c *K6DiameterClient) CheckSendUAR(v sobek.Value) (*CxAnswer, error) {
+	options, err := parseCxRequestOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendCx(cmdUserAuthorization, options)
+}
+
+// SendSAR sends a Server-Assignment-Request without waiting for the answer.
+func (c *K6DiameterClient) SendSAR(v sobek.Value) (bool, error) {
+	return c.sendCx(diam.ServerAssignment, v)
+}
+
+// CheckSendSAR sends a Server-Assignment-Request and returns the answer,
+// with the IMS subscription of the user.
+func (c *K6DiameterClient) CheckSendSAR(v sobek.Value) (*CxAnswer, error) {
+	options, err := parseCxRequestOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendCx(diam.ServerAssignment, options)
+}
+
+// SendLIR sends a Location-Info-Request without waiting for the answer.
+func (c *K6DiameterClient) SendLIR(v sobek.Value) (bool, error) {
+	return c.sendCx(cmdLocationInfo, v)
+}
+
+// CheckSendLIR sends a Location-Info-Request and returns the answer, with
+// the Server-Name of the S-CSCF serving the public identity.
+func (c *K6DiameterClient) CheckSendLIR(v sobek.Value) (*CxAnswer, error) {
+	options, err := parseCxRequestOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendCx(cmdLocationInfo, options)
+}
+
+// SendMAR sends a Multimedia-Auth-Request without waiting for the answer.
+func (c *K6DiameterClient) SendMAR(v sobek.Value) (bool, error) {
+	return c.sendCx(diam.MultimediaAuth, v)
+}
+
+// CheckSendMAR sends a Multimedia-Auth-Request and returns the answer, with
+// its authentication vectors.
+func (c *K6DiameterClient) CheckSendMAR(v sobek.Value) (*CxAnswer, error) {
+	options, err := parseCxRequestOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendCx(diam.MultimediaAuth, options)
+}
+
+func (c *K6DiameterClient) sendCx(code uint32, v sobek.Value) (bool, error) {
+	options, err := parseCxRequestOptions(v)
+	if err != nil {
+		return false, err
+	}
+	co, err := options.connectionOptions(code)
+	if err != nil {
+		return false, err
+	}
+	return c.pick().send(code, cxAppID, co)
+}
+
+func (c *K6DiameterClient) checkSendCx(code uint32, options CxRequestOptions) (*CxAnswer, error) {
+	co, err := options.connectionOptions(code)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.pick().checkSend(code, cxAppID, co)
+	if errors.Is(err, errTimeout) {
+		return nil, errors.Errorf("%s timeout", commandName(cxAppID, code))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newCxAnswer(m), nil
+}
+
+// connectionOptions returns the connection options of the request code with
+// its Cx AVPs added: Vendor-Specific-Application-Id, Auth-Session-State and
+// those set from the options, each unless the script adds it itself.
+func (o *CxRequestOptions) connectionOptions(code uint32) (ConnectionOptions, error) {
+	avps, err := o.avps(code)
+	if err != nil {
+		return o.ConnectionOptions, err
+	}
+	options := addAVPs(o.ConnectionOptions, avps)
+	for _, required := range cxRequired[code] {
+		if !hasAVP(options.Additional, required.avp) {
+			return options, errors.Errorf("missing %s", required.option)
+		}
+	}
+	return options, nil
+}
+
+func (o *CxRequestOptions) avps(code uint32) ([]AVP, error) {
+	avps := []AVP{
+		{Key: "Vendor-Specific-Application-Id", Value: groupAVPs(
+			AVP{Key: "Vendor-Id", Value: int64(vendorId3GPP)},
+			AVP{Key: "Auth-Application-Id", Value: int64(cxAppID)},
+		)},
+		{Key: "Auth-Session-State", Value: int64(authSessionStateNoStateMaintained)},
+	}
+	add := func(key, value string) {
+		if value != "" {
+			avps = append(avps, AVP{Key: key, Value: value})
+		}
+	}
+	identities := o.PublicIdentities
+	if code != diam.ServerAssignment && len(identities) > 1 {
+		identities = identities[:1]
+	}
+
+	switch code {
+	case cmdUserAuthorization:
+		add("User-Name", o.PrivateIdentity)
+		for _, id := range identities {
+			add("Public-Identity", id)
+		}
+		add("Visited-Network-Identifier", o.VisitedNetworkIdentifier)
+		return o.addUserAuthorizationType(avps)
+	case diam.ServerAssignment:
+		add("User-Name", o.PrivateIdentity)
+		for _, id := range identities {
+			add("Public-Identity", id)
+		}
+		add("Server-Name", o.ServerName)
+		if o.ServerAssignmentType != "" {
+			t, err := enumValue("server_assignment_type", serverAssignmentTypes, o.ServerAssignmentType)
+			if err != nil {
+				return nil, err
+			}
+			avps = append(avps, AVP{Key: "Server-Assignment-Type", Value: t})
+		}
+		available := int64(0)
+		if o.UserDataAlreadyAvailable {
+			available = 1
+		}
+		return append(avps, AVP{Key: "User-Data-Already-Available", Value: available}), nil
+	case cmdLocationInfo:
+		if o.Originating {
+			avps = append(avps, AVP{Key: "Originating-Request", Value: int64(0)})
+		}
+		for _, id := range identities {
+			add("Public-Identity", id)
+		}
+		return o.addUserAuthorizationType(avps)
+	case diam.MultimediaAuth:
+		add("User-Name", o.PrivateIdentity)
+		for _, id := range identities {
+			add("Public-Identity", id)
+		}
+		item := o.SipAuthDataItem
+		if item == nil {
+			item = &SIPAuthDataItem{}
+		}
+		members, err := item.avps()
+		if err != nil {
+			return nil, err
+		}
+		count := o.SipNumberAuthItems
+		if count == 0 {
+			count = 1
+		}
+		avps = append(avps,
+			AVP{Key: "SIP-Auth-Data-Item", Value: groupAVPs(members...)},
+			AVP{Key: "SIP-Number-Auth-Items", Value: int64(count)},
+		)
+		add("Server-Name", o.ServerName)
+	}
+	return avps, nil
+}
+
+func (o *CxRequestOptions) addUserAuthorizationType(avps []AVP) ([]AVP, error) {
+	if o.UserAuthorizationType == "" {
+		return avps, nil
+	}
+	t, err := enumValue("user_authorization_type", userAuthorizationTypes, o.UserAuthorizationType)
+	if err != nil {
+		return nil, err
+	}
+	return append(avps, AVP{Key: "User-Authorization-Type", Value: t}), nil
+}
+
+// cxRequired are the mandatory AVPs of the Cx requests (TS 29.229 section
+// 6.1) set from options, with the option setting each.
+var cxRequired = map[uint32][]struct{ avp, option string }{
+	cmdUserAuthorization: {
+		{"User-Name", "private_identity"},
+		{"Public-Identity", "public_identities"},
+		{"Visited-Network-Identifier", "visited_network_identifier"},
+	},
+	diam.ServerAssignment: {
+		{"Server-Name", "server_name"},
+		{"Server-Assignment-Type", "server_assignment_type"},
+	},
+	cmdLocationInfo: {
+		{"Public-Identity", "public_identities"},
+	},
+	diam.MultimediaAuth: {
+		{"User-Name", "private_identity"},
+		{"Public-Identity", "public_identities"},
+		{"Server-Name", "server_name"},
+	},
+}
+
+// enumValue returns the value called name of the enumeration of option.
+func enumValue(option string, values map[string]int64, name string) (int64, error) {
+	v, ok := values[name]
+	if !ok {
+		names := make([]string, 0, len(values))
+		for n := range values {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, errors.Errorf("unknown %s `%s`, want one of %v", option, name, names)
+	}
+	return v, nil
+}
+
+// avps returns the members of the SIP-Auth-Data-Item of a
+// Multimedia-Auth-Request.
+func (item *SIPAuthDataItem) avps() ([]AVP, error) {
+	var avps []AVP
+	if item.ItemNumber != 0 {
+		avps = append(avps, AVP{Key: "SIP-Item-Number", Value: int64(item.ItemNumber)})
+	}
+	scheme := item.Scheme
+	if scheme == "" {
+		scheme = defaultSIPAuthenticationScheme
+	}
+	avps = append(avps, AVP{Key: "SIP-Authentication-Scheme", Value: scheme})
+	for _, field := range []struct {
+		avp, option, value string
+	}{
+		{"SIP-Authenticate", "authenticate", item.Authenticate},
+		{"SIP-Authorization", "authorization", item.Authorization},
+		{"Confidentiality-Key", "confidentiality_key", item.ConfidentialityKey},
+		{"Integrity-Key", "integrity_key", item.IntegrityKey},
+	} {
+		if field.value == "" {
+			continue
+		}
+		b, err := hex.DecodeString(field.value)
+		if err != nil {
+			return nil, invalidOption("sip_auth_data_item."+field.option, "a hex string", field.value)
+		}
+		avps = append(avps, AVP{Key: field.avp, Value: string(b)})
+	}
+	return avps, nil
+}
+
+func newCxAnswer(m *diam.Message) *CxAnswer {
+	a := &CxAnswer{Answer: *newAnswer(m)}
+	for _, item := range m.AVP {
+		if item.Code != avp.SIPAuthDataItem || item.VendorID != vendorId3GPP {
+			continue
+		}
+		a.AuthItems = append(a.AuthItems, decodeSIPAuthDataItem(item))
+	}
+	if data, err := m.FindAVP(avp.UserData, vendorId3GPP); err == nil {
+		if a.UserData, err = decodeUserData(avpString(data)); err != nil {
+			a.UserDataError = err.Error()
+		}
+	}
+	return a
+}
+
+func decodeSIPAuthDataItem(a *diam.AVP) *SIPAuthDataItem {
+	item := &SIPAuthDataItem{}
+	for _, m := range groupMembers(a) {
+		switch m.Code {
+		case avp.SIPItemNumber:
+			item.ItemNumber = uint(avpUint(m))
+		case avp.SIPAuthenticationScheme:
+			item.Scheme = avpString(m)
+		case avp.SIPAuthenticate:
+			item.Authenticate = hex.EncodeToString([]byte(avpString(m)))
+		case avp.SIPAuthorization:
+			item.Authorization = hex.EncodeToString([]byte(avpString(m)))
+		case avp.ConfidentialityKey:
+			item.ConfidentialityKey = hex.EncodeToString([]byte(avpString(m)))
+		case avp.IntegrityKey:
+			item.IntegrityKey = hex.EncodeToString([]byte(avpString(m)))
+		}
+	}
+	return item
+}
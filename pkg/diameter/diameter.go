@@ -26,8 +26,17 @@ type (
 	// RootModule is the global module instance that will create module
 	// instances for each VU.
 	RootModule struct {
-		dialPool *sync.Map
-		mu       sync.Mutex
+		dialPool   *sync.Map
+		peerGroups *sync.Map
+		mu         sync.Mutex
+
+		// clients holds the connected clients by link, to disconnect
+		// them at the end of the test.
+		clients      *sync.Map
+		onTestEndSet sync.Once
+
+		// samples forwards the samples reported outside of the VUs.
+		samples *sampleSink
 	}
 
 	// ModuleInstance represents an instance of the GRPC module for every VU.
@@ -36,6 +45,7 @@ type (
 		vu      modules.VU
 		exports map[string]interface{}
 		rm      *RootModule
+		metrics *diameterMetrics
 	}
 )
 
@@ -46,21 +56,38 @@ var (
 
 func New() *RootModule {
 	return &RootModule{
-		dialPool: new(sync.Map),
+		dialPool:   new(sync.Map),
+		peerGroups: new(sync.Map),
+		clients:    new(sync.Map),
+		samples:    newSampleSink(),
 	}
 }
 
 // NewModuleInstance implements the modules.Module interface to return
 // a new instance for each VU.
 func (rm *RootModule) NewModuleInstance(vu modules.VU) modules.Instance {
+	m, err := registerMetrics(vu.InitEnv().Registry)
+	if err != nil {
+		panic(err)
+	}
 	mi := &ModuleInstance{
 		Version: version,
 		vu:      vu,
 		exports: make(map[string]interface{}),
 		rm:      rm,
+		metrics: m,
 	}
 	mi.exports["K6DiameterClient"] = mi.NewK6DiameterClient
 	mi.exports["K6DiameterClientWithConnect"] = mi.NewK6DiameterClientWithConnect
+	mi.exports["loadDictionary"] = mi.LoadDictionary
+	mi.exports["flags"] = mi.Flags
+	mi.exports["decodeFlags"] = mi.DecodeFlags
+	mi.exports["decodeUserData"] = mi.DecodeUserData
+	rm.samples.setTags(vu.InitEnv().Registry)
+	rm.onTestEndSet.Do(func() { rm.closeOnTestEnd(vu) })
+	if err := mi.loadDictionariesFromEnv(); err != nil {
+		panic(err)
+	}
 	return mi
 }
 
@@ -81,6 +108,7 @@ type ConnectionOptions struct {
 	VendorId        uint
 	ProductName     string
 	HostIPAddresses []string
+	LocalAddr       string
 	AppId           uint
 	Ueimsi          string
 	PlmnID          string
@@ -88,138 +116,184 @@ type ConnectionOptions struct {
 	CompletionSleep uint
 	SessionID       string
 
+	// S6a Purge-UE and Notify
+	PurFlags *uint
+	NorFlags *uint
+
+	// Capabilities exchange. Applications defaults to AppId of VendorId.
+	Applications       []ApplicationOptions
+	SupportedVendorIds []uint
+	InbandSecurityId   uint
+	FirmwareRevision   uint
+
+	TLS  *TLSOptions
+	SCTP *SCTPOptions `js:"sctp"`
+
+	WatchdogInterval uint
+	WatchdogPolicy   string
+
+	DisconnectCause   uint
+	DisconnectTimeout uint
+
+	// Connections shared by K6DiameterClientWithConnect.
+	PoolSize   uint
+	PoolPolicy string
+
+	// Peers simulated by K6DiameterClientWithConnect, numbered in Host and
+	// Realm, connecting from LocalAddrs in turn.
+	Peers      uint
+	LocalAddrs []string
+
+	Reconnect           bool
+	ReconnectBackoff    uint
+	ReconnectMaxBackoff uint
+	AlternateAddrs      []string
+
 	DestinationHost  *datatype.DiameterIdentity
 	DestinationRealm *datatype.DiameterIdentity
 
 	ProxiableFlag bool
 	Additional    []AVP
+
+	// Lenient sends requests without the AVPs that fail to encode, e.g. for
+	// negative testing, instead of failing them.
+	Lenient bool
 }
 
 type K6DiameterClient struct {
-	vu              modules.VU
-	cfg             *sm.Settings
-	Conn            diam.Conn
-	handlerChannels handlerChannels
-}
+	vu       modules.VU
+	rm       *RootModule
+	metrics  *diameterMetrics
+	cfg      *sm.Settings
+	options  ConnectionOptions
+	link     *link
+	pending  *pendingTable
+	inbound  *inboundTable
+	watchdog *watchdog
 
-type handlerChannels struct {
-	checkAIR chan AIAResponce
-	checkULR chan ULAResponce
-	checkCLA chan CLAResponce
+	// pool is set on the clients of K6DiameterClientWithConnect.
+	pool *connPool
 }
 
 func (c *ModuleInstance) NewK6DiameterClientWithConnect(call sobek.ConstructorCall) *sobek.Object {
 	c.rm.mu.Lock()
 	defer c.rm.mu.Unlock()
-	op := call.Arguments[0].Export()
-	options, err := MapToConnectionOptions(op.(map[string]interface{}))
+	options, err := parseConnectionOptions(call.Argument(0))
 	if err != nil {
 		panic(err)
 	}
-	cli := c.rm.connGetPool(options.Host)
-	if cli == nil {
-		cli = &K6DiameterClient{
-			vu: c.vu,
-		}
-		_, err := cli.Connect(options)
-		if err != nil {
-			panic(err)
-		}
-		c.rm.connSetPool(options.Host, cli)
+	var pool *connPool
+	if options.Peers > 0 {
+		pool, err = c.peerPool(options)
+	} else {
+		pool, err = c.pool(options)
 	}
+	if err != nil {
+		panic(err)
+	}
+	cli := pool.clients[0].forVU(c.vu)
+	cli.pool = pool
 	rt := c.vu.Runtime()
 	return rt.ToValue(cli).ToObject(rt)
 }
 
-func (c *RootModule) connSetPool(host string, diam *K6DiameterClient) {
-	c.dialPool.Store(host, diam)
-}
-
-func (c *RootModule) connGetPool(host string) *K6DiameterClient {
-	if diam, ok := c.dialPool.Load(host); ok {
-		return diam.(*K6DiameterClient)
+// pool returns the pool of connections of options, connecting it first if
+// needed.
+func (c *ModuleInstance) pool(options ConnectionOptions) (*connPool, error) {
+	key := poolKey(options)
+	if pool := c.rm.connGetPool(key); pool != nil {
+		return pool, nil
 	}
-	return nil
+	pool, err := c.rm.connectPool(c, options)
+	if err != nil {
+		return nil, err
+	}
+	c.rm.connSetPool(key, pool)
+	return pool, nil
 }
 
-func MapToConnectionOptions(m map[string]interface{}) (ConnectionOptions, error) {
-	var co ConnectionOptions
-
-	if addr, ok := m["addr"].(string); ok {
-		co.Addr = addr
-	}
-	if host, ok := m["host"].(string); ok {
-		co.Host = host
-	}
-	if realm, ok := m["realm"].(string); ok {
-		co.Realm = realm
+// peerPool returns the pool of the peer simulated for the VU, connecting
+// all the peers of options first if needed.
+func (c *ModuleInstance) peerPool(options ConnectionOptions) (*connPool, error) {
+	key := strconv.FormatUint(uint64(options.Peers), 10) + "|" + poolKey(options)
+	if g, ok := c.rm.peerGroups.Load(key); ok {
+		return g.(*peerGroup).pick(), nil
 	}
-	if networkType, ok := m["network_type"].(string); ok {
-		co.NetworkType = networkType
+	g, err := c.rm.connectPeers(c, options)
+	if err != nil {
+		return nil, err
 	}
+	c.rm.peerGroups.Store(key, g)
+	return g.pick(), nil
+}
 
-	mapNumberToUintOpt(&co.Retries, m, "retries")
-	mapNumberToUintOpt(&co.VendorId, m, "vendor_id")
-	mapNumberToUintOpt(&co.AppId, m, "app_id")
-	mapNumberToUintOpt(&co.Vectors, m, "vectors")
-	mapNumberToUintOpt(&co.CompletionSleep, m, "completion_sleep")
-
-	if productName, ok := m["product_name"].(string); ok {
-		co.ProductName = productName
-	}
-	if hostIPAddresses, ok := m["hostipaddresses"].([]interface{}); ok {
-		for _, ip := range hostIPAddresses {
-			if ipStr, ok := ip.(string); ok {
-				co.HostIPAddresses = append(co.HostIPAddresses, ipStr)
-			}
-		}
-	}
-	if ueimsi, ok := m["ueimsi"].(string); ok {
-		co.Ueimsi = ueimsi
-	}
-	if plmnID, ok := m["plmn_id"].(string); ok {
-		co.PlmnID = plmnID
-	}
-	if sessionID, ok := m["session_id"].(string); ok {
-		co.SessionID = sessionID
-	}
-	if destinationHost, ok := m["destination_host"].(*datatype.DiameterIdentity); ok {
-		co.DestinationHost = destinationHost
-	}
-	if destinationRealm, ok := m["destination_realm"].(*datatype.DiameterIdentity); ok {
-		co.DestinationRealm = destinationRealm
-	}
-	if proxiableFlag, ok := m["proxiable_flag"].(bool); ok {
-		co.ProxiableFlag = proxiableFlag
-	}
-	if additional, ok := m["additional"].([]interface{}); ok {
-		for _, avp := range additional {
-			if avpCasted, ok := avp.(AVP); ok {
-				co.Additional = append(co.Additional, avpCasted)
-			}
-		}
-	}
+// forVU returns a view of a pooled client that shares its connection and
+// pending transactions but reports metrics for vu.
+func (c *K6DiameterClient) forVU(vu modules.VU) *K6DiameterClient {
+	view := *c
+	view.vu = vu
+	return &view
+}
 
-	return co, nil
+func (c *RootModule) connSetPool(key string, pool *connPool) {
+	c.dialPool.Store(key, pool)
 }
 
-func mapNumberToUintOpt(target *uint, m map[string]interface{}, key string) {
-	if value, ok := m[key].(int64); ok {
-		*target = uint(value)
+func (c *RootModule) connGetPool(key string) *connPool {
+	if pool, ok := c.dialPool.Load(key); ok {
+		return pool.(*connPool)
 	}
+	return nil
+}
+
+// MapToConnectionOptions parses the connection options of a script, see
+// decodeOptions.
+func MapToConnectionOptions(m map[string]interface{}) (ConnectionOptions, error) {
+	var co ConnectionOptions
+	err := decodeOptions(m, &co)
+	return co, err
 }
 
 func (c *ModuleInstance) NewK6DiameterClient(call sobek.ConstructorCall) *sobek.Object {
 	rt := c.vu.Runtime()
 	cli := &K6DiameterClient{
-		vu: c.vu,
+		vu:      c.vu,
+		metrics: c.metrics,
+		rm:      c.rm,
 	}
 	return rt.ToValue(cli).ToObject(rt)
 }
 
-func (c *K6DiameterClient) Connect(options ConnectionOptions) (bool, error) {
+// Connect connects to the peer and returns the result of the capabilities
+// exchange.
+func (c *K6DiameterClient) Connect(v sobek.Value) (*CapabilitiesExchange, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.connect(options, nil)
+}
+
+// connect connects to the peer, answering its requests from inbound, or
+// from a new table when nil.
+func (c *K6DiameterClient) connect(options ConnectionOptions, inbound *inboundTable) (*CapabilitiesExchange, error) {
 	if len(options.Addr) == 0 {
-		return false, errors.New("missing addr")
+		return nil, errors.New("missing addr")
+	}
+	policy, err := parseWatchdogPolicy(options.WatchdogPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if options.LocalAddr != "" && net.ParseIP(options.LocalAddr) == nil {
+		return nil, errors.Errorf("invalid local_addr `%s`", options.LocalAddr)
+	}
+	if options.SCTP != nil {
+		if !isSCTP(options.NetworkType) {
+			return nil, errors.New("sctp options require network_type sctp")
+		}
+		if err := options.SCTP.validate(); err != nil {
+			return nil, err
+		}
 	}
 	hostIPAddresses := []datatype.Address{}
 	for _, ip := range options.HostIPAddresses {
@@ -231,139 +305,187 @@ func (c *K6DiameterClient) Connect(options ConnectionOptions) (bool, error) {
 		VendorID:         datatype.Unsigned32(options.VendorId),
 		ProductName:      datatype.UTF8String(options.ProductName),
 		OriginStateID:    datatype.Unsigned32(time.Now().Unix()),
-		FirmwareRevision: 1,
+		FirmwareRevision: datatype.Unsigned32(options.FirmwareRevision),
 		HostIPAddresses:  hostIPAddresses,
 	}
-	mux := sm.New(cfg)
-
-	cli := &sm.Client{
-		Dict:             dict.Default,
-		Handler:          mux,
-		MaxRetransmits:   options.Retries,
-		EnableWatchdog:   false,
-		WatchdogInterval: 0,
-		SupportedVendorID: []*diam.AVP{
-			diam.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(options.VendorId)),
-		},
-		VendorSpecificApplicationID: []*diam.AVP{
-			diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
-				AVP: []*diam.AVP{
-					diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(options.AppId)),
-					diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(options.VendorId)),
-				},
-			}),
-		},
-	}
-
-	conn, err := cli.DialNetwork(options.NetworkType, options.Addr)
-	if err != nil {
-		return false, errors.WithMessage(err, "Dial error")
+	if cfg.FirmwareRevision == 0 {
+		cfg.FirmwareRevision = 1
 	}
 	// set MessageHandler
-	c.handlerChannels.checkAIR = make(chan AIAResponce, 1000)
-	mux.HandleIdx(
-		diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.AuthenticationInformation, Request: false},
-		handleAuthenticationInformationAnswer(c.handlerChannels.checkAIR))
-
-	c.handlerChannels.checkULR = make(chan ULAResponce, 1000)
-	mux.HandleIdx(
-		diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.UpdateLocation, Request: false},
-		handleUpdateLocationAnswer(c.handlerChannels.checkULR))
+	c.pending = newPendingTable()
+	if inbound == nil {
+		inbound = newInboundTable(cfg)
+	}
+	c.inbound = inbound
+	c.cfg = cfg
+	c.options = options
 
-	c.handlerChannels.checkCLA = make(chan CLAResponce, 1000)
+	if options.WatchdogInterval > 0 {
+		c.watchdog = newWatchdog(time.Duration(options.WatchdogInterval)*time.Second, policy)
+	}
+	c.link = newLink()
+	if err := c.connectAny(c.link); err != nil {
+		return nil, err
+	}
+	if c.rm != nil {
+		c.rm.clients.Store(c.link, c)
+	}
+	go c.supervise(c.link)
+	if c.watchdog != nil {
+		go c.runWatchdog(c.watchdog)
+	}
+	return c.link.capabilities(), nil
+}
 
-	mux.HandleIdx(diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.CancelLocation, Request: true}, handleCancelLocationAnswer(c.handlerChannels.checkCLA))
+// dial connects to the peer at addr and runs the capabilities exchange.
+func (c *K6DiameterClient) dial(addr string) (diam.Conn, *CapabilitiesExchange, error) {
+	ceac := make(chan *diam.Message, 1)
+	mux := diam.NewServeMux()
+	mux.HandleIdx(diam.CommandIndex{AppID: 0, Code: diam.CapabilitiesExchange, Request: false}, diam.HandlerFunc(func(_ diam.Conn, m *diam.Message) {
+		select {
+		case ceac <- m:
+		default:
+		}
+	}))
+	mux.HandleIdx(diam.CommandIndex{AppID: 0, Code: diam.DeviceWatchdog, Request: true}, handleDWR(c.cfg))
 	// Catch All
-	mux.HandleIdx(diam.ALL_CMD_INDEX, handleAll())
+	mux.HandleIdx(diam.ALL_CMD_INDEX, handleAll(c.pending, c.inbound, c.reportLateAnswer))
 
-	c.Conn = conn
-	c.cfg = cfg
-	return true, nil
-}
-
-func (c *K6DiameterClient) Close() {
-	if c.Conn == nil {
-		return
+	if c.options.InbandSecurityId == inbandSecurityTLS {
+		return c.dialInbandTLS(addr, mux)
 	}
-	c.Conn.Close()
+	var conn diam.Conn
+	var err error
+	if c.options.TLS != nil {
+		var rw net.Conn
+		if rw, err = c.dialTLS(c.options.NetworkType, addr); err == nil {
+			conn, err = diam.NewConn(rw, addr, mux, dict.Default)
+		}
+	} else if isSCTP(c.options.NetworkType) {
+		var rw net.Conn
+		if rw, err = dialSCTP(c.options.NetworkType, addr, c.options.sctpOptions()); err == nil {
+			conn, err = diam.NewConn(rw, addr, mux, dict.Default)
+		}
+	} else {
+		var rw net.Conn
+		if rw, err = c.dialer().Dial(defaultNetwork(c.options.NetworkType), addr); err == nil {
+			conn, err = diam.NewConn(rw, addr, mux, dict.Default)
+		}
+	}
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "Dial error")
+	}
+	cea, err := c.exchangeCapabilities(conn, conn.LocalAddr(), addr, ceac, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	setPeerMetadata(conn, cea)
+	return conn, cea, nil
 }
 
-func (c *K6DiameterClient) generateSessionID() string {
-	return "session;" + strconv.Itoa(int(rand.Uint32()))
+// dialer dials TCP connections from LocalAddr, if set.
+func (c *K6DiameterClient) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if c.options.LocalAddr != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.options.LocalAddr)}
+	}
+	return d
 }
 
-func (c *K6DiameterClient) SendAIR(options ConnectionOptions) (bool, error) {
-	var err error
-	meta, ok := smpeer.FromContext(c.Conn.Context())
-	if !ok {
-		return false, errors.New("peer metadata unavailable")
+func defaultNetwork(networkType string) string {
+	if networkType == "" {
+		return "tcp"
 	}
+	return networkType
+}
 
-	var sid string
-	if options.SessionID != "" {
-		sid = options.SessionID
-	} else {
-		sid = c.generateSessionID()
+// Close disconnects from the peer with a Disconnect-Peer-Request and closes
+// the connection. The connections of a pool, shared by all VUs and simulated
+// peers, are left open until the end of the test.
+func (c *K6DiameterClient) Close() {
+	if c.pool != nil {
+		return
 	}
-	m := diam.NewRequest(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, dict.Default)
-	avps := []AVPMeta{
-		{code: avp.SessionID, flag: avp.Mbit, vendor: 0, value: datatype.UTF8String(sid)},
-		{code: avp.OriginHost, flag: avp.Mbit, vendor: 0, value: c.cfg.OriginHost},
-		{code: avp.OriginRealm, flag: avp.Mbit, vendor: 0, value: c.cfg.OriginRealm},
+	if c.watchdog != nil {
+		c.watchdog.close()
 	}
-	for _, avp := range avps {
-		_, err = m.NewAVP(avp.code, avp.flag, avp.vendor, avp.value)
-		if err != nil {
-			return false, errors.WithMessage(err, "NewAVP failed")
-		}
+	if c.link == nil {
+		return
 	}
-	if options.ProxiableFlag {
-		m.Header.CommandFlags |= diam.ProxiableFlag
+	if c.rm != nil {
+		c.rm.clients.Delete(c.link)
 	}
-	err = modifyMessage(m, meta, options)
-	if err != nil {
-		log.Println(err)
+	state, _ := c.link.status()
+	conn := c.link.close()
+	if conn == nil {
+		return
 	}
-	err = appendAVPs(m, meta, options.Additional)
-	if err != nil {
-		log.Println(err)
+	if state == peerOpen {
+		if err := c.disconnect(); err != nil {
+			log.Println(err)
+		}
 	}
+	conn.Close()
+}
 
-	if _, err := m.WriteTo(c.Conn); err != nil {
-		return false, errors.WithMessage(err, "write message fail")
+func (c *K6DiameterClient) conn() diam.Conn {
+	if c.link == nil {
+		return nil
 	}
-
-	return true, nil
+	return c.link.get()
 }
 
-func (c *K6DiameterClient) CheckSendAIR(options ConnectionOptions) (int64, error) {
-	if _, err := c.SendAIR(options); err != nil {
-		return 0, err
+func (c *K6DiameterClient) peerHost() string {
+	conn := c.conn()
+	if conn == nil {
+		return ""
 	}
-	select {
-	case res := <-c.handlerChannels.checkAIR:
-		if res.Error != nil {
-			return 0, res.Error
-		}
-		return int64(res.AIA.ResultCode), nil
-	case <-time.After(time.Duration(options.CompletionSleep) * time.Second):
-		return 0, errors.New("Authentication Information timeout")
+	if meta, ok := smpeer.FromContext(conn.Context()); ok {
+		return string(meta.OriginHost)
 	}
+	return ""
 }
 
-func (c *K6DiameterClient) SendULR(options ConnectionOptions) (bool, error) {
+func commandName(appID, code uint32) string {
+	cmd, err := dict.Default.FindCommand(appID, code)
+	if err != nil {
+		return strconv.FormatUint(uint64(code), 10)
+	}
+	return cmd.Name
+}
+
+func (c *K6DiameterClient) generateSessionID() string {
+	return "session;" + strconv.Itoa(int(rand.Uint32()))
+}
+
+func (c *K6DiameterClient) newRequest(code, appID uint32, options ConnectionOptions) (*diam.Message, error) {
 	var err error
-	meta, ok := smpeer.FromContext(c.Conn.Context())
+	conn := c.conn()
+	if conn == nil {
+		return nil, errors.New("not connected")
+	}
+	if err := c.link.ready(); err != nil {
+		return nil, err
+	}
+	if c.watchdog != nil && c.watchdog.aborted.Load() {
+		return nil, c.abortTest()
+	}
+	if c.watchdog != nil && c.watchdog.failFast() {
+		return nil, errPeerDown
+	}
+	meta, ok := smpeer.FromContext(conn.Context())
 	if !ok {
-		return false, errors.New("peer metadata unavailable")
+		return nil, errors.New("peer metadata unavailable")
 	}
+
 	var sid string
 	if options.SessionID != "" {
 		sid = options.SessionID
 	} else {
 		sid = c.generateSessionID()
 	}
-	m := diam.NewRequest(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, dict.Default)
+	m := diam.NewRequest(code, appID, dict.Default)
 	avps := []AVPMeta{
 		{code: avp.SessionID, flag: avp.Mbit, vendor: 0, value: datatype.UTF8String(sid)},
 		{code: avp.OriginHost, flag: avp.Mbit, vendor: 0, value: c.cfg.OriginHost},
@@ -372,194 +494,159 @@ func (c *K6DiameterClient) SendULR(options ConnectionOptions) (bool, error) {
 	for _, avp := range avps {
 		_, err = m.NewAVP(avp.code, avp.flag, avp.vendor, avp.value)
 		if err != nil {
-			return false, errors.WithMessage(err, "NewAVP failed")
+			return nil, errors.WithMessage(err, "NewAVP failed")
 		}
 	}
 	if options.ProxiableFlag {
 		m.Header.CommandFlags |= diam.ProxiableFlag
 	}
-	err = modifyMessage(m, meta, options)
-	if err != nil {
-		log.Println(err)
+	if err := encodeError(modifyMessage(m, meta, options), options.Lenient); err != nil {
+		return nil, err
 	}
-	err = appendAVPs(m, meta, options.Additional)
-	if err != nil {
-		log.Println(err)
+	if err := encodeError(appendAVPs(m, meta, options.Additional), options.Lenient); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	if _, err := m.WriteTo(c.Conn); err != nil {
-		return false, errors.WithMessage(err, "write message fail")
+// encodeError returns err, an error encoding the AVPs of a request, or only
+// logs it when lenient.
+func encodeError(err error, lenient bool) error {
+	if err == nil || !lenient {
+		return err
 	}
-
-	return true, nil
+	log.Println(err)
+	return nil
 }
 
-func (c *K6DiameterClient) CheckSendULR(options ConnectionOptions) (int64, error) {
-	if _, err := c.SendULR(options); err != nil {
-		return 0, err
+// defaultSendTimeout is how long the answer to a request sent without
+// waiting for it is expected unless completion_sleep is set. Answers
+// arriving later count as late.
+const defaultSendTimeout = 30 * time.Second
+
+// send sends a request without waiting for its answer. It is counted in
+// diameter_reqs only, without duration or result, and its answer is
+// discarded.
+func (c *K6DiameterClient) send(code, appID uint32, options ConnectionOptions) (bool, error) {
+	m, err := c.newRequest(code, appID, options)
+	if err != nil {
+		return false, err
 	}
-	select {
-	case res := <-c.handlerChannels.checkULR:
-		if res.Error != nil {
-			return 0, res.Error
-		}
-		return int64(res.ULA.ResultCode), nil
-	case <-time.After(time.Duration(options.CompletionSleep) * time.Second):
-		return 0, errors.New("Authentication Information timeout")
+	conn := c.conn()
+	if conn == nil {
+		return false, errors.New("not connected")
 	}
-}
-
-func (c *K6DiameterClient) CheckCLA(wait int64) (int64, error) {
-	select {
-	case res := <-c.handlerChannels.checkCLA:
-		if res.Error != nil {
-			return 0, res.Error
-		}
-		return int64(res.CLA.ResultCode), nil
-	case <-time.After(time.Duration(wait) * time.Second):
-		return 0, errors.New("Cancel Location timeout")
+	timeout := time.Duration(options.CompletionSleep) * time.Second
+	if timeout == 0 {
+		timeout = defaultSendTimeout
 	}
+	tx := c.pending.forget(m, timeout)
+	if _, err := m.WriteTo(conn); err != nil {
+		c.pending.remove(tx)
+		return false, errors.WithMessage(err, "write message fail")
+	}
+	c.reportSent(commandName(appID, code), appID)
+	return true, nil
 }
 
-// S6a/S6d-Indicator | Initial-AttachIndicator
-const ULR_FLAGS = 1<<1 | 1<<5
-
-type EUtranVector struct {
-	RAND  datatype.OctetString `avp:"RAND"`
-	XRES  datatype.OctetString `avp:"XRES"`
-	AUTN  datatype.OctetString `avp:"AUTN"`
-	KASME datatype.OctetString `avp:"KASME"`
-}
-
-type ExperimentalResult struct {
-	ExperimentalResultCode datatype.Unsigned32 `avp:"Experimental-Result-Code"`
-}
-
-type AuthenticationInfo struct {
-	EUtranVector EUtranVector `avp:"E-UTRAN-Vector"`
-}
-
-type AIA struct {
-	SessionID          datatype.UTF8String       `avp:"Session-Id"`
-	ResultCode         datatype.Unsigned32       `avp:"Result-Code"`
-	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
-	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
-	AuthSessionState   datatype.UTF8String       `avp:"Auth-Session-State"`
-	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
-	AIs                []AuthenticationInfo      `avp:"Authentication-Info"`
-}
-
-type AMBR struct {
-	MaxRequestedBandwidthUL uint32 `avp:"Max-Requested-Bandwidth-UL"`
-	MaxRequestedBandwidthDL uint32 `avp:"Max-Requested-Bandwidth-DL"`
-}
-
-type AllocationRetentionPriority struct {
-	PriorityLevel           uint32 `avp:"Priority-Level"`
-	PreemptionCapability    int32  `avp:"Pre-emption-Capability"`
-	PreemptionVulnerability int32  `avp:"Pre-emption-Vulnerability"`
-}
-
-type EPSSubscribedQoSProfile struct {
-	QoSClassIdentifier          int32                       `avp:"QoS-Class-Identifier"`
-	AllocationRetentionPriority AllocationRetentionPriority `avp:"Allocation-Retention-Priority"`
-}
-
-type APNConfiguration struct {
-	ContextIdentifier       uint32                  `avp:"Context-Identifier"`
-	PDNType                 int32                   `avp:"PDN-Type"`
-	ServiceSelection        string                  `avp:"Service-Selection"`
-	EPSSubscribedQoSProfile EPSSubscribedQoSProfile `avp:"EPS-Subscribed-QoS-Profile"`
-	AMBR                    AMBR                    `avp:"AMBR"`
-}
-
-type APNConfigurationProfile struct {
-	ContextIdentifier                     uint32           `avp:"Context-Identifier"`
-	AllAPNConfigurationsIncludedIndicator int32            `avp:"All-APN-Configurations-Included-Indicator"`
-	APNConfiguration                      APNConfiguration `avp:"APN-Configuration"`
-}
-
-type SubscriptionData struct {
-	MSISDN                        datatype.OctetString    `avp:"MSISDN"`
-	AccessRestrictionData         uint32                  `avp:"Access-Restriction-Data"`
-	SubscriberStatus              int32                   `avp:"Subscriber-Status"`
-	NetworkAccessMode             int32                   `avp:"Network-Access-Mode"`
-	AMBR                          AMBR                    `avp:"AMBR"`
-	APNConfigurationProfile       APNConfigurationProfile `avp:"APN-Configuration-Profile"`
-	SubscribedPeriodicRauTauTimer uint32                  `avp:"Subscribed-Periodic-RAU-TAU-Timer"`
+// checkSend sends a request and waits for its answer, reporting the
+// exchange to the metrics registry.
+func (c *K6DiameterClient) checkSend(code, appID uint32, options ConnectionOptions) (*diam.Message, error) {
+	m, err := c.newRequest(code, appID, options)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendMessage(m, time.Duration(options.CompletionSleep)*time.Second)
 }
 
-type ULA struct {
-	SessionID          string                    `avp:"Session-Id"`
-	ULAFlags           uint32                    `avp:"ULA-Flags"`
-	SubscriptionData   SubscriptionData          `avp:"Subscription-Data"`
-	AuthSessionState   int32                     `avp:"Auth-Session-State"`
-	ResultCode         uint32                    `avp:"Result-Code"`
-	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
-	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
-	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
+func (c *K6DiameterClient) checkSendMessage(m *diam.Message, timeout time.Duration) (*diam.Message, error) {
+	ex := exchange{
+		Command: commandName(m.Header.ApplicationID, m.Header.CommandCode),
+		AppID:   m.Header.ApplicationID,
+		Peer:    c.peerHost(),
+		Start:   time.Now(),
+	}
+	a, err := c.roundTrip(m, timeout)
+	if errors.Is(err, errTimeout) {
+		ex.Timeout = true
+		c.reportExchange(ex)
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "write message fail")
+	}
+	ex.ResultCode, ex.ExperimentalResultCode = resultCodes(a)
+	c.reportExchange(ex)
+	return a, nil
 }
 
-type CLA struct {
-	SessionId        string                    `avp:"Session-Id"`
-	AuthSessionState int32                     `avp:"Auth-Session-State"`
-	ResultCode       uint32                    `avp:"Result-Code"`
-	OriginHost       datatype.DiameterIdentity `avp:"Origin-Host"`
-	OriginRealm      datatype.DiameterIdentity `avp:"Origin-Realm"`
+func (c *K6DiameterClient) SendAIR(v sobek.Value) (bool, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return false, err
+	}
+	return c.pick().send(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, options)
 }
 
-type AIAResponce struct {
-	AIA   AIA
-	Error error
-}
-type ULAResponce struct {
-	ULA   ULA
-	Error error
+func (c *K6DiameterClient) CheckSendAIR(v sobek.Value) (int64, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return 0, err
+	}
+	return c.checkSendAIR(options)
 }
 
-type CLAResponce struct {
-	CLA   CLA
-	Error error
+func (c *K6DiameterClient) checkSendAIR(options ConnectionOptions) (int64, error) {
+	c = c.pick()
+	a, err := c.checkSend(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, options)
+	if errors.Is(err, errTimeout) {
+		return 0, errors.New("Authentication Information timeout")
+	}
+	if err != nil {
+		return 0, err
+	}
+	resultCode, _ := resultCodes(a)
+	return int64(resultCode), nil
 }
 
-func handleAuthenticationInformationAnswer(done chan AIAResponce) diam.HandlerFunc {
-	return func(c diam.Conn, m *diam.Message) {
-		var aia AIA
-		err := m.Unmarshal(&aia)
-		if err != nil {
-			done <- AIAResponce{Error: errors.WithMessage(err, "AIA Unmarshal failed")}
-			return
-		}
-		done <- AIAResponce{AIA: aia, Error: nil}
+func (c *K6DiameterClient) SendULR(v sobek.Value) (bool, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return false, err
 	}
+	return c.pick().send(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, options)
 }
 
-func handleUpdateLocationAnswer(done chan ULAResponce) diam.HandlerFunc {
-	return func(c diam.Conn, m *diam.Message) {
-		var ula ULA
-		err := m.Unmarshal(&ula)
-		if err != nil {
-			done <- ULAResponce{Error: errors.WithMessage(err, "ULA Unmarshal failed")}
-			return
-		}
-		done <- ULAResponce{ULA: ula, Error: nil}
+func (c *K6DiameterClient) CheckSendULR(v sobek.Value) (int64, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return 0, err
 	}
+	return c.checkSendULR(options)
 }
 
-func handleCancelLocationAnswer(done chan CLAResponce) diam.HandlerFunc {
-	return func(c diam.Conn, m *diam.Message) {
-		var cla CLA
-		err := m.Unmarshal(&cla)
-		if err != nil {
-			done <- CLAResponce{Error: errors.WithMessage(err, "CLA Unmarshal failed")}
-			return
-		}
-		done <- CLAResponce{CLA: cla, Error: nil}
+func (c *K6DiameterClient) checkSendULR(options ConnectionOptions) (int64, error) {
+	c = c.pick()
+	a, err := c.checkSend(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, options)
+	if errors.Is(err, errTimeout) {
+		return 0, errors.New("Update Location timeout")
+	}
+	if err != nil {
+		return 0, err
 	}
+	resultCode, _ := resultCodes(a)
+	return int64(resultCode), nil
 }
 
-func handleAll() diam.HandlerFunc {
-	return func(c diam.Conn, m *diam.Message) {
-		log.Printf("Received Meesage From %s\n%s\n", c.RemoteAddr(), m)
+// CheckCLA waits for a Cancel-Location-Request and returns the result code
+// it was answered with.
+func (c *K6DiameterClient) CheckCLA(wait int64) (int64, error) {
+	req, err := c.WaitRequest("Cancel-Location", wait)
+	if err != nil {
+		return 0, err
 	}
+	return int64(req.AnsweredWith), nil
 }
+
+// S6a/S6d-Indicator | Initial-AttachIndicator
+const ULR_FLAGS = 1<<1 | 1<<5
@@ -0,0 +1,89 @@
+package diameter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.k6.io/k6/lib/fsext"
+
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// dictionariesEnv names the k6 environment variable holding a comma
+// separated list of dictionary files loaded by every VU's init context.
+const dictionariesEnv = "DIAMETER_DICTIONARIES"
+
+// loadedDictionaries records the dictionary files already loaded into
+// dict.Default, since the init context runs once per VU.
+var loadedDictionaries = struct {
+	sync.Mutex
+	files map[string]struct{}
+}{files: make(map[string]struct{})}
+
+// LoadDictionary loads a go-diameter XML dictionary file. Its commands can
+// then be used by Request and its AVPs in `additional` and `avps` lists and
+// when decoding answers. It can only be called in the init context.
+func (mi *ModuleInstance) LoadDictionary(path string) error {
+	if mi.vu.State() != nil {
+		return errors.New("loadDictionary must be called in the init context")
+	}
+	if path == "" {
+		return errors.New("missing dictionary path")
+	}
+	initEnv := mi.vu.InitEnv()
+	filename := initEnv.GetAbsFilePath(path)
+	data, err := fsext.ReadFile(initEnv.FileSystems["file"], filename)
+	if err != nil {
+		return errors.WithMessage(err, "read dictionary")
+	}
+	return loadDictionary(filename, data)
+}
+
+// loadDictionariesFromEnv loads the dictionaries listed in dictionariesEnv.
+func (mi *ModuleInstance) loadDictionariesFromEnv() error {
+	paths := mi.vu.InitEnv().RuntimeOptions.Env[dictionariesEnv]
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if err := mi.LoadDictionary(path); err != nil {
+			return errors.WithMessagef(err, "%s: %s", dictionariesEnv, path)
+		}
+	}
+	return nil
+}
+
+func loadDictionary(name string, data []byte) error {
+	loadedDictionaries.Lock()
+	defer loadedDictionaries.Unlock()
+	if _, ok := loadedDictionaries.files[name]; ok {
+		return nil
+	}
+
+	var f dict.File
+	if err := xml.Unmarshal(data, &f); err != nil {
+		return errors.WithMessagef(err, "parse dictionary %s", name)
+	}
+	if err := dict.Default.Load(bytes.NewReader(data)); err != nil {
+		return errors.WithMessagef(err, "load dictionary %s", name)
+	}
+	// AVPs of the loaded file take precedence over same-named AVPs of
+	// other applications. AVPs of types without a converter are left to
+	// lookupAVP, which reports them when they are used.
+	for _, app := range f.App {
+		for _, def := range app.AVP {
+			def.Data.Type = datatype.Available[def.Data.TypeName]
+			if meta, err := newAVPMeta(def); err == nil {
+				registerAVP(def.Name, meta)
+			}
+		}
+	}
+	resetAVPNames()
+	loadedDictionaries.files[name] = struct{}{}
+	return nil
+}
@@ -0,0 +1,420 @@
+package diameter
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+)
+
+// GxRequestOptions describes the Gx AVPs of a Credit-Control-Request (TS
+// 29.212 section 5.6.2). Unset options leave their AVP out.
+type GxRequestOptions struct {
+	// SubscriptionIds defaults to the ueimsi of the session in CCR-Initials.
+	SubscriptionIds     []SubscriptionID
+	FramedIpAddress     string
+	CalledStationId     string
+	IpCanType           *uint
+	RatType             *uint
+	QosInformation      *QoSInformation
+	DefaultEpsBearerQos *BearerQoS
+	EventTriggers       []uint
+	UsageMonitoring     []UsageMonitoring
+
+	// TerminationCause defaults to DIAMETER_LOGOUT in CCR-Terminations.
+	TerminationCause uint
+
+	Avps []AVP
+}
+
+// BearerQoS is the QoS class and Allocation-Retention-Priority of a bearer.
+type BearerQoS struct {
+	Qci uint
+	Arp *AllocationRetentionPriority
+}
+
+// AllocationRetentionPriority is the ARP of a bearer (TS 29.212 section
+// 5.3.32).
+type AllocationRetentionPriority struct {
+	PriorityLevel           uint
+	PreEmptionCapability    *uint
+	PreEmptionVulnerability *uint
+}
+
+// QoSInformation is the QoS requested for the IP-CAN session.
+type QoSInformation struct {
+	BearerQoS
+	MaxRequestedBandwidthUl  uint
+	MaxRequestedBandwidthDl  uint
+	ApnAggregateMaxBitrateUl uint
+	ApnAggregateMaxBitrateDl uint
+}
+
+// UsageMonitoring reports the usage of a monitoring key.
+type UsageMonitoring struct {
+	MonitoringKey    string
+	Level            *uint
+	UsedTotalOctets  *uint64
+	UsedInputOctets  *uint64
+	UsedOutputOctets *uint64
+}
+
+// ChargingRule is a PCC rule installed by the PCRF: a predefined rule
+// activated by Name, a rule base activated by BaseName, or a dynamic rule
+// with its definition.
+type ChargingRule struct {
+	Name             string
+	BaseName         string
+	Dynamic          bool
+	Precedence       uint32
+	FlowDescriptions []string
+	FlowStatus       *int32
+	RatingGroup      uint32
+	MonitoringKey    string
+	Qci              uint32
+}
+
+// MonitoringGrant is the usage granted by the PCRF for a monitoring key.
+type MonitoringGrant struct {
+	MonitoringKey string
+	Level         int32
+	TotalOctets   uint64
+	InputOctets   uint64
+	OutputOctets  uint64
+}
+
+// GxAnswer is a Credit-Control-Answer of a Gx session with the policy it
+// carries decoded.
+type GxAnswer struct {
+	Answer
+	RulesInstalled  []*ChargingRule
+	RulesRemoved    []string
+	EventTriggers   []int32
+	UsageMonitoring []*MonitoringGrant
+}
+
+// GxSession is an IP-CAN session of the PCEF with the PCRF. It keeps the
+// Session-Id and CC-Request-Number of its requests, and the PCC rules the
+// PCRF installed with its answers and Re-Auth-Requests.
+type GxSession struct {
+	SessionId string
+
+	s     *ccSession
+	mu    sync.Mutex
+	rules map[string]*ChargingRule
+}
+
+// GxSession returns a new Gx session. Its Credit-Control-Requests carry
+// options: session_id, destination_host, destination_realm, additional AVPs,
+// completion_sleep as the answer timeout, and ueimsi as the default
+// Subscription-Id.
+func (c *K6DiameterClient) GxSession(v sobek.Value) (*GxSession, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newCCSession(c, diam.GX_CHARGING_CONTROL_APP_ID, options)
+	if err != nil {
+		return nil, err
+	}
+	g := &GxSession{
+		SessionId: s.id,
+		s:         s,
+		rules:     make(map[string]*ChargingRule),
+	}
+	s.received = func(m *diam.Message) {
+		installed, removed := decodeRuleChanges(m.AVP)
+		g.apply(installed, removed)
+	}
+	return g, nil
+}
+
+// Initial sends the CCR-Initial of the session.
+func (g *GxSession) Initial(v sobek.Value) (*GxAnswer, error) {
+	return g.request(ccInitialRequest, v)
+}
+
+// Update sends a CCR-Update of the session.
+func (g *GxSession) Update(v sobek.Value) (*GxAnswer, error) {
+	return g.request(ccUpdateRequest, v)
+}
+
+// Terminate sends the CCR-Termination of the session.
+func (g *GxSession) Terminate(v sobek.Value) (*GxAnswer, error) {
+	return g.request(ccTerminationRequest, v)
+}
+
+// WaitRequest waits up to wait seconds for a request of the PCRF for the
+// session, e.g. a Re-Auth-Request. The rules it installs and removes are
+// applied when it is received.
+func (g *GxSession) WaitRequest(wait int64) (*InboundRequest, error) {
+	return g.s.waitRequest(wait)
+}
+
+// Rules returns the PCC rules installed in the session, by name.
+func (g *GxSession) Rules() []*ChargingRule {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]string, 0, len(g.rules))
+	for key := range g.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rules := make([]*ChargingRule, len(keys))
+	for i, key := range keys {
+		rules[i] = g.rules[key]
+	}
+	return rules
+}
+
+func (g *GxSession) request(requestType uint32, v sobek.Value) (*GxAnswer, error) {
+	var options GxRequestOptions
+	if err := exportOptions(v, &options); err != nil {
+		return nil, err
+	}
+	avps, err := options.avps(requestType, g.s.options.Ueimsi)
+	if err != nil {
+		return nil, err
+	}
+	m, err := g.s.exchange(requestType, avps)
+	if err != nil {
+		return nil, err
+	}
+	a := newGxAnswer(m)
+	g.apply(a.RulesInstalled, a.RulesRemoved)
+	return a, nil
+}
+
+func (g *GxSession) apply(installed []*ChargingRule, removed []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range removed {
+		delete(g.rules, name)
+	}
+	for _, rule := range installed {
+		g.rules[rule.key()] = rule
+	}
+}
+
+func (r *ChargingRule) key() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.BaseName
+}
+
+// avps returns the AVPs of a request of type requestType.
+func (o *GxRequestOptions) avps(requestType uint32, ueimsi string) ([]AVP, error) {
+	avps, err := subscriptionIDAVPs(o.SubscriptionIds, initialIMSI(requestType, ueimsi))
+	if err != nil {
+		return nil, err
+	}
+	if o.FramedIpAddress != "" {
+		ip := net.ParseIP(o.FramedIpAddress).To4()
+		if ip == nil {
+			return nil, errors.Errorf("invalid framed_ip_address `%s`", o.FramedIpAddress)
+		}
+		avps = append(avps, AVP{Key: "Framed-IP-Address", Value: string(ip)})
+	}
+	if o.CalledStationId != "" {
+		avps = append(avps, AVP{Key: "Called-Station-Id", Value: o.CalledStationId})
+	}
+	if o.IpCanType != nil {
+		avps = append(avps, AVP{Key: "IP-CAN-Type", Value: int64(*o.IpCanType)})
+	}
+	if o.RatType != nil {
+		avps = append(avps, AVP{Key: "RAT-Type", Value: int64(*o.RatType)})
+	}
+	if o.QosInformation != nil {
+		avps = append(avps, AVP{Key: "QoS-Information", Value: groupAVPs(o.QosInformation.avps()...)})
+	}
+	if o.DefaultEpsBearerQos != nil {
+		avps = append(avps, AVP{Key: "Default-EPS-Bearer-QoS", Value: groupAVPs(o.DefaultEpsBearerQos.avps()...)})
+	}
+	for _, trigger := range o.EventTriggers {
+		avps = append(avps, AVP{Key: "Event-Trigger", Value: int64(trigger)})
+	}
+	for _, u := range o.UsageMonitoring {
+		avps = append(avps, AVP{Key: "Usage-Monitoring-Information", Value: groupAVPs(u.avps()...)})
+	}
+	cause := int64(o.TerminationCause)
+	if cause == 0 && requestType == ccTerminationRequest {
+		cause = terminationCauseLogout
+	}
+	if cause != 0 {
+		avps = append(avps, AVP{Key: "Termination-Cause", Value: cause})
+	}
+	return append(avps, o.Avps...), nil
+}
+
+func (q *BearerQoS) avps() []AVP {
+	var avps []AVP
+	if q.Qci != 0 {
+		avps = append(avps, AVP{Key: "QoS-Class-Identifier", Value: int64(q.Qci)})
+	}
+	if q.Arp != nil {
+		arp := []AVP{{Key: "Priority-Level", Value: int64(q.Arp.PriorityLevel)}}
+		if q.Arp.PreEmptionCapability != nil {
+			arp = append(arp, AVP{Key: "Pre-emption-Capability", Value: int64(*q.Arp.PreEmptionCapability)})
+		}
+		if q.Arp.PreEmptionVulnerability != nil {
+			arp = append(arp, AVP{Key: "Pre-emption-Vulnerability", Value: int64(*q.Arp.PreEmptionVulnerability)})
+		}
+		avps = append(avps, AVP{Key: "Allocation-Retention-Priority", Value: groupAVPs(arp...)})
+	}
+	return avps
+}
+
+func (q *QoSInformation) avps() []AVP {
+	avps := q.BearerQoS.avps()
+	for _, b := range []struct {
+		key   string
+		value uint
+	}{
+		{"Max-Requested-Bandwidth-UL", q.MaxRequestedBandwidthUl},
+		{"Max-Requested-Bandwidth-DL", q.MaxRequestedBandwidthDl},
+		{"APN-Aggregate-Max-Bitrate-UL", q.ApnAggregateMaxBitrateUl},
+		{"APN-Aggregate-Max-Bitrate-DL", q.ApnAggregateMaxBitrateDl},
+	} {
+		if b.value != 0 {
+			avps = append(avps, AVP{Key: b.key, Value: int64(b.value)})
+		}
+	}
+	return avps
+}
+
+func (u *UsageMonitoring) avps() []AVP {
+	avps := []AVP{{Key: "Monitoring-Key", Value: u.MonitoringKey}}
+	var used []AVP
+	for _, o := range []struct {
+		key   string
+		value *uint64
+	}{
+		{"CC-Total-Octets", u.UsedTotalOctets},
+		{"CC-Input-Octets", u.UsedInputOctets},
+		{"CC-Output-Octets", u.UsedOutputOctets},
+	} {
+		if o.value != nil {
+			used = append(used, AVP{Key: o.key, Value: int64(*o.value)})
+		}
+	}
+	if len(used) > 0 {
+		avps = append(avps, AVP{Key: "Used-Service-Unit", Value: groupAVPs(used...)})
+	}
+	if u.Level != nil {
+		avps = append(avps, AVP{Key: "Usage-Monitoring-Level", Value: int64(*u.Level)})
+	}
+	return avps
+}
+
+func newGxAnswer(m *diam.Message) *GxAnswer {
+	a := &GxAnswer{Answer: *newAnswer(m)}
+	a.RulesInstalled, a.RulesRemoved = decodeRuleChanges(m.AVP)
+	for _, e := range m.AVP {
+		if e.VendorID != vendorId3GPP {
+			continue
+		}
+		switch e.Code {
+		case avp.EventTrigger:
+			a.EventTriggers = append(a.EventTriggers, int32(avpUint(e)))
+		case avp.UsageMonitoringInformation:
+			a.UsageMonitoring = append(a.UsageMonitoring, decodeMonitoringGrant(e))
+		}
+	}
+	return a
+}
+
+// decodeRuleChanges returns the PCC rules installed and the names of the
+// rules and rule bases removed by the Charging-Rule-Install and
+// Charging-Rule-Remove AVPs of avps.
+func decodeRuleChanges(avps []*diam.AVP) (installed []*ChargingRule, removed []string) {
+	for _, a := range avps {
+		if a.VendorID != vendorId3GPP {
+			continue
+		}
+		switch a.Code {
+		case avp.ChargingRuleInstall:
+			for _, member := range groupMembers(a) {
+				switch member.Code {
+				case avp.ChargingRuleName:
+					installed = append(installed, &ChargingRule{Name: avpString(member)})
+				case avp.ChargingRuleBaseName:
+					installed = append(installed, &ChargingRule{BaseName: avpString(member)})
+				case avp.ChargingRuleDefinition:
+					installed = append(installed, decodeRuleDefinition(member))
+				}
+			}
+		case avp.ChargingRuleRemove:
+			for _, member := range groupMembers(a) {
+				if member.Code == avp.ChargingRuleName || member.Code == avp.ChargingRuleBaseName {
+					removed = append(removed, avpString(member))
+				}
+			}
+		}
+	}
+	return installed, removed
+}
+
+func decodeRuleDefinition(a *diam.AVP) *ChargingRule {
+	rule := &ChargingRule{Dynamic: true}
+	for _, member := range groupMembers(a) {
+		switch member.Code {
+		case avp.ChargingRuleName:
+			rule.Name = avpString(member)
+		case avp.Precedence:
+			rule.Precedence = uint32(avpUint(member))
+		case avp.FlowInformation:
+			for _, flow := range groupMembers(member) {
+				if flow.Code == avp.FlowDescription {
+					rule.FlowDescriptions = append(rule.FlowDescriptions, avpString(flow))
+				}
+			}
+		case avp.FlowDescription:
+			// Flow-Description AVPs of releases before Flow-Information
+			rule.FlowDescriptions = append(rule.FlowDescriptions, avpString(member))
+		case avp.FlowStatus:
+			status := int32(avpUint(member))
+			rule.FlowStatus = &status
+		case avp.RatingGroup:
+			rule.RatingGroup = uint32(avpUint(member))
+		case avp.MonitoringKey:
+			rule.MonitoringKey = avpString(member)
+		case avp.QoSInformation:
+			for _, qos := range groupMembers(member) {
+				if qos.Code == avp.QoSClassIdentifier {
+					rule.Qci = uint32(avpUint(qos))
+				}
+			}
+		}
+	}
+	return rule
+}
+
+func decodeMonitoringGrant(a *diam.AVP) *MonitoringGrant {
+	grant := &MonitoringGrant{}
+	for _, member := range groupMembers(a) {
+		switch member.Code {
+		case avp.MonitoringKey:
+			grant.MonitoringKey = avpString(member)
+		case avp.UsageMonitoringLevel:
+			grant.Level = int32(avpUint(member))
+		case avp.GrantedServiceUnit:
+			for _, unit := range groupMembers(member) {
+				switch unit.Code {
+				case avp.CCTotalOctets:
+					grant.TotalOctets = avpUint(unit)
+				case avp.CCInputOctets:
+					grant.InputOctets = avpUint(unit)
+				case avp.CCOutputOctets:
+					grant.OutputOctets = avpUint(unit)
+				}
+			}
+		}
+	}
+	return grant
+}
@@ -0,0 +1,582 @@
+package diameter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+)
+
+// resultCreditLimitReached is DIAMETER_CREDIT_LIMIT_REACHED (RFC 4006
+// section 9.1).
+const resultCreditLimitReached = 4012
+
+// defaultServiceContextID is the Service-Context-Id of requests unless set,
+// that of PS charging (TS 32.299).
+const defaultServiceContextID = "32251@3gpp.org"
+
+// multipleServicesSupported is the Multiple-Services-Indicator of
+// CCR-Initials.
+const multipleServicesSupported = 1
+
+// Reporting-Reason values (TS 32.299 section 7.2.175).
+const (
+	reportingReasonFinal                 = 2
+	reportingReasonQuotaExhausted        = 3
+	reportingReasonValidityTime          = 4
+	reportingReasonForcedReauthorisation = 7
+)
+
+// GyRequestOptions describes the Gy AVPs of a Credit-Control-Request (TS
+// 32.299 section 6.4.2). Without Mscc, the Multiple-Services-Credit-Control
+// AVPs are those of the quotas of the session, see GySession.
+type GyRequestOptions struct {
+	// SubscriptionIds defaults to the ueimsi of the session in CCR-Initials.
+	SubscriptionIds []SubscriptionID
+	// ServiceContextId defaults to 32251@3gpp.org, PS charging.
+	ServiceContextId string
+	Mscc             []MsccOptions
+
+	// TerminationCause defaults to DIAMETER_LOGOUT in CCR-Terminations.
+	TerminationCause uint
+
+	Avps []AVP
+}
+
+// MsccOptions is a Multiple-Services-Credit-Control AVP of a request.
+type MsccOptions struct {
+	RatingGroup        *uint
+	ServiceIdentifiers []uint
+	Requested          *ServiceUnits
+	Used               *ServiceUnits
+	ReportingReason    *uint
+}
+
+// ServiceUnits are units of service requested, granted or used. Unset
+// units are left out.
+type ServiceUnits struct {
+	Time                 *uint64
+	TotalOctets          *uint64
+	InputOctets          *uint64
+	OutputOctets         *uint64
+	ServiceSpecificUnits *uint64
+}
+
+// Credit is the credit granted for a rating group by a
+// Multiple-Services-Credit-Control AVP of an answer.
+type Credit struct {
+	RatingGroup         uint32
+	ServiceIdentifiers  []uint32
+	ResultCode          uint32
+	Granted             ServiceUnits
+	ValidityTime        uint32
+	FinalUnitIndication *FinalUnitIndication
+}
+
+// FinalUnitIndication tells what to do once the granted units, the last
+// ones, are used (RFC 4006 section 8.34).
+type FinalUnitIndication struct {
+	// Action is TERMINATE (0), REDIRECT (1) or RESTRICT_ACCESS (2).
+	Action                 int32
+	RestrictionFilterRules []string
+	FilterIds              []string
+	RedirectAddressType    *int32
+	RedirectServerAddress  string
+}
+
+// Quota is the credit of a rating group of a session and the units used
+// since they were last reported. It is Exhausted once a granted unit is
+// used up and Expired after its Validity-Time.
+type Quota struct {
+	Credit
+	Used      ServiceUnits
+	Exhausted bool
+	Expired   bool
+
+	grantedAt time.Time
+	reauth    bool
+}
+
+// GyAnswer is a Credit-Control-Answer of a Gy session with its
+// Multiple-Services-Credit-Control AVPs decoded. CreditLimitReached is set
+// when the answer or one of them has Result-Code 4012.
+type GyAnswer struct {
+	Answer
+	Mscc               []*Credit
+	CreditLimitReached bool
+}
+
+// GySession is an online charging session with the OCS. It keeps the
+// Session-Id and CC-Request-Number of its requests, and the quota granted
+// for each rating group.
+//
+// Scripts report the units a subscriber uses with Consume. Update then
+// reports the usage of the quotas that are exhausted, expired or asked for
+// by a Re-Auth-Request and requests more credit for them, and Terminate
+// reports the usage of all the quotas.
+type GySession struct {
+	SessionId string
+
+	s      *ccSession
+	mu     sync.Mutex
+	quotas map[uint32]*Quota
+}
+
+// GySession returns a new Gy session. Its Credit-Control-Requests carry
+// options: session_id, destination_host, destination_realm, additional AVPs,
+// completion_sleep as the answer timeout, and ueimsi as the default
+// Subscription-Id.
+func (c *K6DiameterClient) GySession(v sobek.Value) (*GySession, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newCCSession(c, diam.CHARGING_CONTROL_APP_ID, options)
+	if err != nil {
+		return nil, err
+	}
+	g := &GySession{
+		SessionId: s.id,
+		s:         s,
+		quotas:    make(map[uint32]*Quota),
+	}
+	s.received = g.reauthorize
+	return g, nil
+}
+
+// Initial sends the CCR-Initial of the session, by default requesting
+// credit without a rating group.
+func (g *GySession) Initial(v sobek.Value) (*GyAnswer, error) {
+	return g.request(ccInitialRequest, v)
+}
+
+// Update sends a CCR-Update of the session.
+func (g *GySession) Update(v sobek.Value) (*GyAnswer, error) {
+	return g.request(ccUpdateRequest, v)
+}
+
+// Terminate sends the CCR-Termination of the session.
+func (g *GySession) Terminate(v sobek.Value) (*GyAnswer, error) {
+	return g.request(ccTerminationRequest, v)
+}
+
+// WaitRequest waits up to wait seconds for a request of the OCS for the
+// session, e.g. a Re-Auth-Request, after which Update reports the quotas
+// it names.
+func (g *GySession) WaitRequest(wait int64) (*InboundRequest, error) {
+	return g.s.waitRequest(wait)
+}
+
+// Consume adds the units in v, e.g. { total_octets: 1000 }, to the units
+// used of the quota of ratingGroup and returns the quota. Total octets
+// default to the sum of input and output octets.
+func (g *GySession) Consume(ratingGroup uint32, v sobek.Value) (*Quota, error) {
+	var units ServiceUnits
+	if err := exportOptions(v, &units); err != nil {
+		return nil, err
+	}
+	if units.TotalOctets == nil && (units.InputOctets != nil || units.OutputOctets != nil) {
+		total := unitValue(units.InputOctets) + unitValue(units.OutputOctets)
+		units.TotalOctets = &total
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	q, ok := g.quotas[ratingGroup]
+	if !ok {
+		return nil, errors.Errorf("no quota for rating group %d", ratingGroup)
+	}
+	q.Used = q.Used.add(units)
+	return q.snapshot(time.Now()), nil
+}
+
+// Quota returns the quota of ratingGroup, or null.
+func (g *GySession) Quota(ratingGroup uint32) *Quota {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if q, ok := g.quotas[ratingGroup]; ok {
+		return q.snapshot(time.Now())
+	}
+	return nil
+}
+
+// Quotas returns the quotas of the session by rating group.
+func (g *GySession) Quotas() []*Quota {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	quotas := make([]*Quota, 0, len(g.quotas))
+	for _, rg := range g.ratingGroups() {
+		quotas = append(quotas, g.quotas[rg].snapshot(now))
+	}
+	return quotas
+}
+
+// NeedsUpdate reports whether a quota is to be reported with Update.
+func (g *GySession) NeedsUpdate() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, q := range g.quotas {
+		if q.reportingReason(now) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GySession) request(requestType uint32, v sobek.Value) (*GyAnswer, error) {
+	var options GyRequestOptions
+	if err := exportOptions(v, &options); err != nil {
+		return nil, err
+	}
+	var reported map[uint32]ServiceUnits
+	if len(options.Mscc) == 0 {
+		options.Mscc, reported = g.reports(requestType)
+	}
+	avps, err := options.avps(requestType, g.s.options.Ueimsi)
+	if err != nil {
+		return nil, err
+	}
+	m, err := g.s.exchange(requestType, avps)
+	if err != nil {
+		return nil, err
+	}
+	a := newGyAnswer(m)
+	g.update(requestType, a.Mscc, reported)
+	return a, nil
+}
+
+// reports returns the Multiple-Services-Credit-Control AVPs of a request of
+// type requestType without AVPs set by the script, with the units they
+// report by rating group.
+func (g *GySession) reports(requestType uint32) ([]MsccOptions, map[uint32]ServiceUnits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if requestType == ccInitialRequest {
+		return []MsccOptions{{Requested: &ServiceUnits{}}}, nil
+	}
+	now := time.Now()
+	var mscc []MsccOptions
+	reported := make(map[uint32]ServiceUnits)
+	for _, rg := range g.ratingGroups() {
+		q := g.quotas[rg]
+		reason := q.reportingReason(now)
+		if requestType == ccTerminationRequest {
+			reason = reportingReasonFinal
+		} else if reason == 0 {
+			continue
+		}
+		rg := uint(rg)
+		report := MsccOptions{RatingGroup: &rg, ReportingReason: &reason}
+		for _, id := range q.ServiceIdentifiers {
+			report.ServiceIdentifiers = append(report.ServiceIdentifiers, uint(id))
+		}
+		if !q.Used.empty() {
+			used := q.Used
+			report.Used = &used
+		}
+		if requestType != ccTerminationRequest {
+			report.Requested = &ServiceUnits{}
+		}
+		mscc = append(mscc, report)
+		reported[q.RatingGroup] = q.Used
+	}
+	return mscc, reported
+}
+
+// update applies the answer to a request of type requestType that reported
+// the units reported: the reported units are no longer used, and quotas
+// reported for more credit and not granted any are removed.
+func (g *GySession) update(requestType uint32, credits []*Credit, reported map[uint32]ServiceUnits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if requestType == ccTerminationRequest {
+		g.quotas = make(map[uint32]*Quota)
+		return
+	}
+	now := time.Now()
+	for rg, units := range reported {
+		if q, ok := g.quotas[rg]; ok {
+			q.Used = q.Used.sub(units)
+			q.reauth = false
+		}
+	}
+	granted := make(map[uint32]bool, len(credits))
+	for _, c := range credits {
+		q, ok := g.quotas[c.RatingGroup]
+		if !ok {
+			q = &Quota{}
+			g.quotas[c.RatingGroup] = q
+		}
+		q.Credit = *c
+		q.grantedAt = now
+		granted[c.RatingGroup] = true
+	}
+	for rg := range reported {
+		if !granted[rg] {
+			delete(g.quotas, rg)
+		}
+	}
+}
+
+// reauthorize marks the quotas of the rating group of the Re-Auth-Request
+// m, or all the quotas, to be reported.
+func (g *GySession) reauthorize(m *diam.Message) {
+	if m.Header.CommandCode != diam.ReAuth {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if rg, err := m.FindAVP(avp.RatingGroup, 0); err == nil {
+		if q, ok := g.quotas[uint32(avpUint(rg))]; ok {
+			q.reauth = true
+		}
+		return
+	}
+	for _, q := range g.quotas {
+		q.reauth = true
+	}
+}
+
+func (g *GySession) ratingGroups() []uint32 {
+	rgs := make([]uint32, 0, len(g.quotas))
+	for rg := range g.quotas {
+		rgs = append(rgs, rg)
+	}
+	sort.Slice(rgs, func(i, j int) bool { return rgs[i] < rgs[j] })
+	return rgs
+}
+
+// snapshot returns a copy of q at now for scripts.
+func (q *Quota) snapshot(now time.Time) *Quota {
+	s := *q
+	s.Exhausted = q.exhausted()
+	s.Expired = q.expired(now)
+	return &s
+}
+
+func (q *Quota) exhausted() bool {
+	for _, u := range [][2]*uint64{
+		{q.Granted.Time, q.Used.Time},
+		{q.Granted.TotalOctets, q.Used.TotalOctets},
+		{q.Granted.InputOctets, q.Used.InputOctets},
+		{q.Granted.OutputOctets, q.Used.OutputOctets},
+		{q.Granted.ServiceSpecificUnits, q.Used.ServiceSpecificUnits},
+	} {
+		if u[0] != nil && unitValue(u[1]) >= *u[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quota) expired(now time.Time) bool {
+	return q.ValidityTime > 0 && !now.Before(q.grantedAt.Add(time.Duration(q.ValidityTime)*time.Second))
+}
+
+// reportingReason returns why q is to be reported, or 0. Exhausted final
+// units are not: the Final-Unit-Action applies instead.
+func (q *Quota) reportingReason(now time.Time) uint {
+	switch {
+	case q.reauth:
+		return reportingReasonForcedReauthorisation
+	case q.expired(now):
+		return reportingReasonValidityTime
+	case q.exhausted() && q.FinalUnitIndication == nil:
+		return reportingReasonQuotaExhausted
+	}
+	return 0
+}
+
+// avps returns the AVPs of a request of type requestType.
+func (o *GyRequestOptions) avps(requestType uint32, ueimsi string) ([]AVP, error) {
+	avps, err := subscriptionIDAVPs(o.SubscriptionIds, initialIMSI(requestType, ueimsi))
+	if err != nil {
+		return nil, err
+	}
+	contextID := o.ServiceContextId
+	if contextID == "" {
+		contextID = defaultServiceContextID
+	}
+	avps = append(avps, AVP{Key: "Service-Context-Id", Value: contextID})
+	if requestType == ccInitialRequest {
+		avps = append(avps, AVP{Key: "Multiple-Services-Indicator", Value: int64(multipleServicesSupported)})
+	}
+	for _, mscc := range o.Mscc {
+		avps = append(avps, AVP{Key: "Multiple-Services-Credit-Control", Value: groupAVPs(mscc.avps()...)})
+	}
+	cause := int64(o.TerminationCause)
+	if cause == 0 && requestType == ccTerminationRequest {
+		cause = terminationCauseLogout
+	}
+	if cause != 0 {
+		avps = append(avps, AVP{Key: "Termination-Cause", Value: cause})
+	}
+	return append(avps, o.Avps...), nil
+}
+
+func (o *MsccOptions) avps() []AVP {
+	var avps []AVP
+	if o.Requested != nil {
+		avps = append(avps, AVP{Key: "Requested-Service-Unit", Value: groupAVPs(o.Requested.avps()...)})
+	}
+	if o.Used != nil {
+		avps = append(avps, AVP{Key: "Used-Service-Unit", Value: groupAVPs(o.Used.avps()...)})
+	}
+	for _, id := range o.ServiceIdentifiers {
+		avps = append(avps, AVP{Key: "Service-Identifier", Value: int64(id)})
+	}
+	if o.RatingGroup != nil {
+		avps = append(avps, AVP{Key: "Rating-Group", Value: int64(*o.RatingGroup)})
+	}
+	if o.ReportingReason != nil {
+		avps = append(avps, AVP{Key: "Reporting-Reason", Value: int64(*o.ReportingReason)})
+	}
+	return avps
+}
+
+func (u ServiceUnits) avps() []AVP {
+	var avps []AVP
+	for _, unit := range []struct {
+		key   string
+		value *uint64
+	}{
+		{"CC-Time", u.Time},
+		{"CC-Total-Octets", u.TotalOctets},
+		{"CC-Input-Octets", u.InputOctets},
+		{"CC-Output-Octets", u.OutputOctets},
+		{"CC-Service-Specific-Units", u.ServiceSpecificUnits},
+	} {
+		if unit.value != nil {
+			avps = append(avps, AVP{Key: unit.key, Value: int64(*unit.value)})
+		}
+	}
+	return avps
+}
+
+func (u ServiceUnits) empty() bool {
+	return u.Time == nil && u.TotalOctets == nil && u.InputOctets == nil && u.OutputOctets == nil && u.ServiceSpecificUnits == nil
+}
+
+// add returns the sum of u and v. The units set in neither stay unset.
+func (u ServiceUnits) add(v ServiceUnits) ServiceUnits {
+	return u.combine(v, func(a, b *uint64) *uint64 {
+		if a == nil && b == nil {
+			return nil
+		}
+		n := unitValue(a) + unitValue(b)
+		return &n
+	})
+}
+
+// sub returns u less v. The units used up become unset.
+func (u ServiceUnits) sub(v ServiceUnits) ServiceUnits {
+	return u.combine(v, func(a, b *uint64) *uint64 {
+		if unitValue(a) <= unitValue(b) {
+			return nil
+		}
+		n := unitValue(a) - unitValue(b)
+		return &n
+	})
+}
+
+func (u ServiceUnits) combine(v ServiceUnits, op func(a, b *uint64) *uint64) ServiceUnits {
+	return ServiceUnits{
+		Time:                 op(u.Time, v.Time),
+		TotalOctets:          op(u.TotalOctets, v.TotalOctets),
+		InputOctets:          op(u.InputOctets, v.InputOctets),
+		OutputOctets:         op(u.OutputOctets, v.OutputOctets),
+		ServiceSpecificUnits: op(u.ServiceSpecificUnits, v.ServiceSpecificUnits),
+	}
+}
+
+func unitValue(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func newGyAnswer(m *diam.Message) *GyAnswer {
+	a := &GyAnswer{Answer: *newAnswer(m)}
+	a.CreditLimitReached = a.ResultCode == resultCreditLimitReached
+	for _, e := range m.AVP {
+		if e.Code == avp.MultipleServicesCreditControl && e.VendorID == 0 {
+			c := decodeCredit(e)
+			a.Mscc = append(a.Mscc, c)
+			a.CreditLimitReached = a.CreditLimitReached || c.ResultCode == resultCreditLimitReached
+		}
+	}
+	return a
+}
+
+func decodeCredit(a *diam.AVP) *Credit {
+	c := &Credit{}
+	for _, member := range groupMembers(a) {
+		switch member.Code {
+		case avp.RatingGroup:
+			c.RatingGroup = uint32(avpUint(member))
+		case avp.ServiceIdentifier:
+			c.ServiceIdentifiers = append(c.ServiceIdentifiers, uint32(avpUint(member)))
+		case avp.ResultCode:
+			c.ResultCode = uint32(avpUint(member))
+		case avp.GrantedServiceUnit:
+			c.Granted = decodeServiceUnits(member)
+		case avp.ValidityTime:
+			c.ValidityTime = uint32(avpUint(member))
+		case avp.FinalUnitIndication:
+			c.FinalUnitIndication = decodeFinalUnitIndication(member)
+		}
+	}
+	return c
+}
+
+func decodeServiceUnits(a *diam.AVP) ServiceUnits {
+	var u ServiceUnits
+	for _, member := range groupMembers(a) {
+		n := avpUint(member)
+		switch member.Code {
+		case avp.CCTime:
+			u.Time = &n
+		case avp.CCTotalOctets:
+			u.TotalOctets = &n
+		case avp.CCInputOctets:
+			u.InputOctets = &n
+		case avp.CCOutputOctets:
+			u.OutputOctets = &n
+		case avp.CCServiceSpecificUnits:
+			u.ServiceSpecificUnits = &n
+		}
+	}
+	return u
+}
+
+func decodeFinalUnitIndication(a *diam.AVP) *FinalUnitIndication {
+	fui := &FinalUnitIndication{}
+	for _, member := range groupMembers(a) {
+		switch member.Code {
+		case avp.FinalUnitAction:
+			fui.Action = int32(avpUint(member))
+		case avp.RestrictionFilterRule:
+			fui.RestrictionFilterRules = append(fui.RestrictionFilterRules, avpString(member))
+		case avp.FilterID:
+			fui.FilterIds = append(fui.FilterIds, avpString(member))
+		case avp.RedirectServer:
+			for _, server := range groupMembers(member) {
+				switch server.Code {
+				case avp.RedirectAddressType:
+					t := int32(avpUint(server))
+					fui.RedirectAddressType = &t
+				case avp.RedirectServerAddress:
+					fui.RedirectServerAddress = avpString(server)
+				}
+			}
+		}
+	}
+	return fui
+}
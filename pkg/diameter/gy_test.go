@@ -0,0 +1,251 @@
+package diameter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/sobek"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+func units(n uint64) *uint64 {
+	return &n
+}
+
+// newTestGySession returns a Gy session granted credits by its CCR-Initial.
+func newTestGySession(credits ...*Credit) *GySession {
+	g := &GySession{quotas: make(map[uint32]*Quota)}
+	g.update(ccInitialRequest, credits, nil)
+	return g
+}
+
+func TestGySessionConsume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		credit   Credit
+		consumed []map[string]interface{}
+		want     ServiceUnits
+		wantErr  bool
+		needs    bool
+	}{
+		{
+			name:     "below the grant",
+			credit:   Credit{RatingGroup: 10, Granted: ServiceUnits{TotalOctets: units(1000)}},
+			consumed: []map[string]interface{}{{"total_octets": int64(400)}, {"total_octets": int64(500)}},
+			want:     ServiceUnits{TotalOctets: units(900)},
+		},
+		{
+			name:     "total octets from input and output",
+			credit:   Credit{RatingGroup: 10, Granted: ServiceUnits{TotalOctets: units(1000)}},
+			consumed: []map[string]interface{}{{"input_octets": int64(600), "output_octets": int64(400)}},
+			want:     ServiceUnits{TotalOctets: units(1000), InputOctets: units(600), OutputOctets: units(400)},
+			needs:    true,
+		},
+		{
+			name:     "time exhausted",
+			credit:   Credit{RatingGroup: 10, Granted: ServiceUnits{Time: units(60), TotalOctets: units(1000)}},
+			consumed: []map[string]interface{}{{"time": int64(60)}},
+			want:     ServiceUnits{Time: units(60)},
+			needs:    true,
+		},
+		{
+			name: "final units exhausted",
+			credit: Credit{
+				RatingGroup:         10,
+				Granted:             ServiceUnits{TotalOctets: units(1000)},
+				FinalUnitIndication: &FinalUnitIndication{},
+			},
+			consumed: []map[string]interface{}{{"total_octets": int64(1000)}},
+			want:     ServiceUnits{TotalOctets: units(1000)},
+		},
+		{
+			name:     "unknown rating group",
+			credit:   Credit{RatingGroup: 20, Granted: ServiceUnits{TotalOctets: units(1000)}},
+			consumed: []map[string]interface{}{{"total_octets": int64(1)}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid units",
+			credit:   Credit{RatingGroup: 10, Granted: ServiceUnits{TotalOctets: units(1000)}},
+			consumed: []map[string]interface{}{{"octets": int64(1)}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			rt := sobek.New()
+			credit := tt.credit
+			g := newTestGySession(&credit)
+			var q *Quota
+			var err error
+			for _, consumed := range tt.consumed {
+				if q, err = g.Consume(10, rt.ToValue(consumed)); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Consume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(q.Used, tt.want) {
+				t.Errorf("Consume() used = %s, want %s", formatUnits(q.Used), formatUnits(tt.want))
+			}
+			if got := g.NeedsUpdate(); got != tt.needs {
+				t.Errorf("NeedsUpdate() = %v, want %v", got, tt.needs)
+			}
+			if q.Exhausted != (tt.needs || tt.credit.FinalUnitIndication != nil) {
+				t.Errorf("Consume() exhausted = %v", q.Exhausted)
+			}
+		})
+	}
+}
+
+func TestQuotaReportingReason(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		quota Quota
+		want  uint
+	}{
+		{
+			name:  "unused",
+			quota: Quota{Credit: Credit{Granted: ServiceUnits{TotalOctets: units(1000)}, ValidityTime: 60}, grantedAt: now},
+			want:  0,
+		},
+		{
+			name:  "exhausted",
+			quota: Quota{Credit: Credit{Granted: ServiceUnits{TotalOctets: units(1000)}}, Used: ServiceUnits{TotalOctets: units(1000)}},
+			want:  reportingReasonQuotaExhausted,
+		},
+		{
+			name:  "expired",
+			quota: Quota{Credit: Credit{ValidityTime: 60}, grantedAt: now.Add(-time.Minute)},
+			want:  reportingReasonValidityTime,
+		},
+		{
+			name:  "no validity time",
+			quota: Quota{grantedAt: now.Add(-time.Hour)},
+			want:  0,
+		},
+		{
+			name:  "reauthorized",
+			quota: Quota{Credit: Credit{ValidityTime: 60}, grantedAt: now.Add(-time.Minute), reauth: true},
+			want:  reportingReasonForcedReauthorisation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := tt.quota.reportingReason(now); got != tt.want {
+				t.Errorf("reportingReason() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGySessionUpdate(t *testing.T) {
+	t.Parallel()
+
+	rt := sobek.New()
+	g := newTestGySession(
+		&Credit{RatingGroup: 10, Granted: ServiceUnits{TotalOctets: units(1000)}},
+		&Credit{RatingGroup: 20, Granted: ServiceUnits{TotalOctets: units(1000)}},
+		&Credit{RatingGroup: 30, Granted: ServiceUnits{TotalOctets: units(1000)}},
+	)
+	for rg, used := range map[uint32]int64{10: 1000, 20: 1200, 30: 10} {
+		if _, err := g.Consume(rg, rt.ToValue(map[string]interface{}{"total_octets": used})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mscc, reported := g.reports(ccUpdateRequest)
+	if len(mscc) != 2 || *mscc[0].RatingGroup != 10 || *mscc[1].RatingGroup != 20 {
+		t.Fatalf("reports() = %+v, want the exhausted rating groups 10 and 20", mscc)
+	}
+	if *mscc[0].ReportingReason != reportingReasonQuotaExhausted || mscc[0].Requested == nil {
+		t.Errorf("reports()[0] = %+v", mscc[0])
+	}
+
+	// Units used while the request is outstanding are kept.
+	if _, err := g.Consume(10, rt.ToValue(map[string]interface{}{"total_octets": int64(100)})); err != nil {
+		t.Fatal(err)
+	}
+	// The OCS grants rating group 10 again but not 20.
+	g.update(ccUpdateRequest, []*Credit{{RatingGroup: 10, Granted: ServiceUnits{TotalOctets: units(500)}}}, reported)
+
+	if q := g.Quota(10); q == nil || unitValue(q.Used.TotalOctets) != 100 || unitValue(q.Granted.TotalOctets) != 500 {
+		t.Errorf("Quota(10) = %+v, want 100 of 500 octets used", q)
+	}
+	if q := g.Quota(20); q != nil {
+		t.Errorf("Quota(20) = %+v, want none", q)
+	}
+	if q := g.Quota(30); q == nil || unitValue(q.Used.TotalOctets) != 10 {
+		t.Errorf("Quota(30) = %+v, want 10 octets used", q)
+	}
+	if g.NeedsUpdate() {
+		t.Error("NeedsUpdate() = true after the update")
+	}
+
+	mscc, _ = g.reports(ccTerminationRequest)
+	if len(mscc) != 2 || *mscc[0].ReportingReason != reportingReasonFinal || mscc[0].Requested != nil {
+		t.Errorf("reports(termination) = %+v, want the final report of 2 quotas", mscc)
+	}
+	g.update(ccTerminationRequest, nil, nil)
+	if quotas := g.Quotas(); len(quotas) != 0 {
+		t.Errorf("Quotas() = %+v after termination, want none", quotas)
+	}
+}
+
+func TestGySessionReauthorize(t *testing.T) {
+	t.Parallel()
+
+	ratingGroup := uint32(20)
+	tests := []struct {
+		name        string
+		ratingGroup *uint32
+		want        []uint32
+	}{
+		{name: "all quotas", want: []uint32{10, 20}},
+		{name: "rating group", ratingGroup: &ratingGroup, want: []uint32{20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			g := newTestGySession(&Credit{RatingGroup: 10}, &Credit{RatingGroup: 20})
+			rar := diam.NewRequest(diam.ReAuth, diam.CHARGING_CONTROL_APP_ID, dict.Default)
+			if tt.ratingGroup != nil {
+				rar.NewAVP(avp.RatingGroup, avp.Mbit, 0, datatype.Unsigned32(*tt.ratingGroup))
+			}
+			g.reauthorize(rar)
+			mscc, _ := g.reports(ccUpdateRequest)
+			var got []uint32
+			for _, m := range mscc {
+				if *m.ReportingReason != reportingReasonForcedReauthorisation {
+					t.Errorf("reports() reason = %d", *m.ReportingReason)
+				}
+				got = append(got, uint32(*m.RatingGroup))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reports() rating groups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// formatUnits formats the units set in u.
+func formatUnits(u ServiceUnits) string {
+	return fmt.Sprint(u.avps())
+}
@@ -0,0 +1,421 @@
+package diameter
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+)
+
+// inboxSize is the number of unclaimed inbound requests kept per command.
+const inboxSize = 1000
+
+// functionAnswerTimeout is how long a request answered by a function waits
+// for the script to receive it before it is answered statically.
+const functionAnswerTimeout = 2 * time.Second
+
+// AnswerOptions describes the answer sent to an inbound request. The answer
+// carries Result-Code 2001 when neither result code is set.
+type AnswerOptions struct {
+	ResultCode             uint
+	ExperimentalResultCode uint
+	Avps                   []AVP
+}
+
+// InboundRequest is a request received from the peer. AnsweredWith is the
+// result code of the answer sent back, or 0 if it was not answered.
+type InboundRequest struct {
+	Command      string
+	AppId        uint32
+	Flags        uint8
+	HopByHopId   uint32
+	EndToEndId   uint32
+	Avps         map[string]interface{}
+	AvpList      []*DecodedAVP
+	AnsweredWith uint32
+
+	conn diam.Conn
+	msg  *diam.Message
+
+	// fallback answers the request when its answer function cannot.
+	fallback AnswerOptions
+	claimed  atomic.Bool
+	answered atomic.Uint32
+}
+
+// claim reports whether the caller is the first to answer the request.
+func (r *InboundRequest) claim() bool {
+	return r.claimed.CompareAndSwap(false, true)
+}
+
+// snapshot returns a copy of the request for scripts, which the answer
+// sent later from another goroutine leaves as it is.
+func (r *InboundRequest) snapshot() *InboundRequest {
+	return &InboundRequest{
+		Command:      r.Command,
+		AppId:        r.AppId,
+		Flags:        r.Flags,
+		HopByHopId:   r.HopByHopId,
+		EndToEndId:   r.EndToEndId,
+		Avps:         r.Avps,
+		AvpList:      r.AvpList,
+		AnsweredWith: r.answered.Load(),
+	}
+}
+
+// answerSpec is how requests of a command are answered: with a static
+// answer, or by a JS function called when the script receives the request.
+type answerSpec struct {
+	static AnswerOptions
+	fn     sobek.Callable
+	rt     *sobek.Runtime
+
+	// byDefault is set on the answers of defaultAnswers.
+	byDefault bool
+}
+
+// inboundTable answers the requests received from the peer and keeps them
+// for scripts waiting on them.
+type inboundTable struct {
+	cfg *sm.Settings
+
+	mu      sync.Mutex
+	answers map[diam.CommandIndex]*answerSpec
+	inbox   map[diam.CommandIndex]chan *InboundRequest
+
+	// sessions are the open sessions of the scripts by Session-Id.
+	sessions sync.Map
+
+	// dropLogged is set once a full inbox dropped a request.
+	dropLogged atomic.Bool
+}
+
+// defaultAnswers are the requests answered with success unless configured
+// otherwise: Disconnect-Peer, the S6a requests an HSS sends to the
+// MME/SGSN, the Cx requests it sends to the S-CSCF, the Re-Auth-Requests of
+// the PCRF and the OCS, and the Abort-Session-Requests of the PCRF to the
+// AF.
+var defaultAnswers = []diam.CommandIndex{
+	{AppID: 0, Code: diam.DisconnectPeer, Request: true},
+	{AppID: diam.GX_CHARGING_CONTROL_APP_ID, Code: diam.ReAuth, Request: true},
+	{AppID: diam.CHARGING_CONTROL_APP_ID, Code: diam.ReAuth, Request: true},
+	{AppID: diam.RX_APP_ID, Code: diam.ReAuth, Request: true},
+	{AppID: diam.RX_APP_ID, Code: diam.AbortSession, Request: true},
+	{AppID: diam.TGPP_S6A_APP_ID, Code: diam.CancelLocation, Request: true},
+	{AppID: diam.TGPP_S6A_APP_ID, Code: diam.InsertSubscriberData, Request: true},
+	{AppID: diam.TGPP_S6A_APP_ID, Code: diam.DeleteSubscriberData, Request: true},
+	{AppID: diam.TGPP_S6A_APP_ID, Code: diam.Reset, Request: true},
+	{AppID: cxAppID, Code: diam.RegistrationTermination, Request: true},
+	{AppID: cxAppID, Code: cmdPushProfile, Request: true},
+}
+
+func newInboundTable(cfg *sm.Settings) *inboundTable {
+	t := &inboundTable{
+		cfg:     cfg,
+		answers: make(map[diam.CommandIndex]*answerSpec),
+		inbox:   make(map[diam.CommandIndex]chan *InboundRequest),
+	}
+	for _, idx := range defaultAnswers {
+		t.answers[idx] = &answerSpec{byDefault: true}
+	}
+	return t
+}
+
+func (t *inboundTable) setAnswer(idx diam.CommandIndex, spec *answerSpec) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.answers[idx] = spec
+}
+
+func (t *inboundTable) answer(idx diam.CommandIndex) (*answerSpec, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spec, ok := t.answers[idx]
+	return spec, ok
+}
+
+func (t *inboundTable) queue(idx diam.CommandIndex) chan *InboundRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.inbox[idx]
+	if !ok {
+		q = make(chan *InboundRequest, inboxSize)
+		t.inbox[idx] = q
+	}
+	return q
+}
+
+func (t *inboundTable) addSession(s *session) {
+	t.sessions.Store(s.id, s)
+}
+
+func (t *inboundTable) removeSession(s *session) {
+	t.sessions.CompareAndDelete(s.id, s)
+}
+
+// session returns the open session m belongs to, or nil.
+func (t *inboundTable) session(m *diam.Message) *session {
+	sid, err := m.FindAVP(avp.SessionID, 0)
+	if err != nil {
+		return nil
+	}
+	id, ok := sid.Data.(datatype.UTF8String)
+	if !ok {
+		return nil
+	}
+	if s, ok := t.sessions.Load(string(id)); ok {
+		return s.(*session)
+	}
+	return nil
+}
+
+// serve answers m when an answer is configured for its command and keeps it
+// for WaitRequest, or for the session it belongs to. Requests answered by a
+// function are answered statically unless a script receives them within
+// functionAnswerTimeout. Requests without a configured answer are only
+// logged.
+func (t *inboundTable) serve(c diam.Conn, m *diam.Message) {
+	idx := diam.CommandIndex{AppID: m.Header.ApplicationID, Code: m.Header.CommandCode, Request: true}
+	spec, ok := t.answer(idx)
+	if !ok {
+		log.Printf("Received Meesage From %s\n%s\n", c.RemoteAddr(), m)
+		return
+	}
+	req := newInboundRequest(c, m)
+	inbox := t.queue(idx)
+	options := spec.static
+	if s := t.session(m); s != nil {
+		if s.received != nil {
+			s.received(m)
+		}
+		inbox = s.inbox
+	} else if spec.byDefault && (idx.Code == diam.ReAuth || idx.Code == diam.AbortSession) {
+		options.ResultCode = diam.UnknownSessionID
+	}
+	req.fallback = options
+	if spec.fn == nil {
+		t.replyOnce(req, options)
+	} else {
+		time.AfterFunc(functionAnswerTimeout, func() { t.replyOnce(req, options) })
+	}
+	t.push(inbox, req)
+}
+
+// replyOnce answers req with options unless it was already answered.
+func (t *inboundTable) replyOnce(req *InboundRequest, options AnswerOptions) {
+	if !req.claim() {
+		return
+	}
+	if err := t.reply(req, options); err != nil {
+		log.Println(err)
+	}
+}
+
+// push keeps req in inbox, dropping the oldest requests when it is full so
+// that it holds the latest ones. Only the first drop is logged.
+func (t *inboundTable) push(inbox chan *InboundRequest, req *InboundRequest) {
+	for {
+		select {
+		case inbox <- req:
+			return
+		default:
+		}
+		select {
+		case old := <-inbox:
+			if t.dropLogged.CompareAndSwap(false, true) {
+				log.Printf("inbox full, dropping the oldest requests, e.g. %s, that no script waited for\n", old.Command)
+			}
+		default:
+		}
+	}
+}
+
+// reply sends the answer described by options to req.
+func (t *inboundTable) reply(req *InboundRequest, options AnswerOptions) error {
+	m := req.msg
+	a := m.Answer(0)
+	if sid, err := m.FindAVP(avp.SessionID, 0); err == nil {
+		a.AddAVP(sid)
+	}
+	resultCode := uint32(options.ResultCode)
+	if options.ExperimentalResultCode != 0 {
+		a.NewAVP(avp.ExperimentalResult, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(vendorId3GPP)),
+				diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(options.ExperimentalResultCode)),
+			},
+		})
+		resultCode = uint32(options.ExperimentalResultCode)
+	} else {
+		if resultCode == 0 {
+			resultCode = diam.Success
+		}
+		a.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(resultCode))
+	}
+	if m.Header.ApplicationID == diam.TGPP_S6A_APP_ID || m.Header.ApplicationID == cxAppID {
+		addS6aAnswerAVPs(a, m)
+	} else if state, err := m.FindAVP(avp.AuthSessionState, 0); err == nil {
+		a.AddAVP(state)
+	}
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, t.cfg.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, t.cfg.OriginRealm)
+	if err := appendAVPs(a, nil, options.Avps); err != nil {
+		return errors.WithMessagef(err, "answer to %s", req.Command)
+	}
+	if _, err := a.WriteTo(req.conn); err != nil {
+		return errors.WithMessage(err, "write answer fail")
+	}
+	req.answered.Store(resultCode)
+	return nil
+}
+
+func newInboundRequest(c diam.Conn, m *diam.Message) *InboundRequest {
+	req := &InboundRequest{
+		Command:    commandName(m.Header.ApplicationID, m.Header.CommandCode),
+		AppId:      m.Header.ApplicationID,
+		Flags:      m.Header.CommandFlags,
+		HopByHopId: m.Header.HopByHopID,
+		EndToEndId: m.Header.EndToEndID,
+		conn:       c,
+		msg:        m,
+	}
+	req.Avps, req.AvpList = decodeAVPs(m.Header.ApplicationID, m.AVP)
+	return req
+}
+
+// handleAll correlates answers with their requests, calling late for those
+// that cannot be, and serves requests.
+func handleAll(pending *pendingTable, inbound *inboundTable, late func()) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		if m.Header.CommandFlags&diam.RequestFlag == 0 {
+			if !pending.deliver(m) {
+				late()
+			}
+			return
+		}
+		inbound.serve(c, m)
+	}
+}
+
+// SetAnswer configures how requests of command are answered: with a static
+// answer ({result_code, experimental_result_code, avps}), or with a function
+// receiving the request and returning such an answer. Function answers are
+// produced when the script receives the request with WaitRequest, or the
+// request is answered with 2001 if it does not in time.
+func (c *K6DiameterClient) SetAnswer(command string, answer sobek.Value) error {
+	if c.inbound == nil {
+		return errors.New("not connected")
+	}
+	code, appID, err := c.resolveInbound(command)
+	if err != nil {
+		return err
+	}
+	spec := &answerSpec{}
+	rt := c.vu.Runtime()
+	if fn, ok := sobek.AssertFunction(answer); ok {
+		spec.fn = fn
+		spec.rt = rt
+	} else if answer != nil && !sobek.IsUndefined(answer) && !sobek.IsNull(answer) {
+		if err := rt.ExportTo(answer, &spec.static); err != nil {
+			return errors.WithMessage(err, "invalid answer")
+		}
+		// AVPs that fail to encode are reported now rather than when the
+		// request arrives.
+		if err := appendAVPs(diam.NewMessage(code, 0, appID, 0, 0, dict.Default), nil, spec.static.Avps); err != nil {
+			return errors.WithMessage(err, "invalid answer")
+		}
+	}
+	c.inbound.setAnswer(diam.CommandIndex{AppID: appID, Code: code, Request: true}, spec)
+	return nil
+}
+
+// WaitRequest waits up to wait seconds for a request of command from the
+// peer. Requests answered by a function are answered before returning.
+func (c *K6DiameterClient) WaitRequest(command string, wait int64) (*InboundRequest, error) {
+	if c.inbound == nil {
+		return nil, errors.New("not connected")
+	}
+	code, appID, err := c.resolveInbound(command)
+	if err != nil {
+		return nil, err
+	}
+	idx := diam.CommandIndex{AppID: appID, Code: code, Request: true}
+	select {
+	case req := <-c.inbound.queue(idx):
+		return c.answerReceived(req)
+	case <-time.After(time.Duration(wait) * time.Second):
+		return nil, errors.Errorf("%s timeout", commandName(appID, code))
+	}
+}
+
+// resolveInbound returns the command code and application id of the
+// requests of command the peer sends. Commands defined by several
+// applications, e.g. Registration-Termination by SWx and Cx, are those of
+// the applications the client advertised.
+func (c *K6DiameterClient) resolveInbound(command string) (uint32, uint32, error) {
+	for _, adv := range c.options.applications() {
+		app, err := dict.Default.App(uint32(adv.AppId))
+		if err != nil {
+			continue
+		}
+		for _, cmd := range app.Command {
+			if matchCommand(cmd, command) {
+				return cmd.Code, app.ID, nil
+			}
+		}
+	}
+	return resolveCommand(command, 0, 0)
+}
+
+// answerReceived answers req, just received by the script, with the answer
+// function of its command if it has one, and returns it for the script. When
+// the function fails, req is answered with its fallback answer.
+func (c *K6DiameterClient) answerReceived(req *InboundRequest) (*InboundRequest, error) {
+	idx := diam.CommandIndex{AppID: req.AppId, Code: req.msg.Header.CommandCode, Request: true}
+	spec, ok := c.inbound.answer(idx)
+	if !ok || spec.fn == nil || req.claimed.Load() {
+		return req.snapshot(), nil
+	}
+	options, err := c.functionAnswer(spec, req)
+	if err != nil {
+		c.inbound.replyOnce(req, req.fallback)
+		return nil, err
+	}
+	if req.claim() {
+		if err := c.inbound.reply(req, options); err != nil {
+			return nil, err
+		}
+	}
+	return req.snapshot(), nil
+}
+
+// functionAnswer returns the answer the function of spec builds for req.
+func (c *K6DiameterClient) functionAnswer(spec *answerSpec, req *InboundRequest) (AnswerOptions, error) {
+	var options AnswerOptions
+	rt := c.vu.Runtime()
+	if spec.rt != rt {
+		return options, errors.Errorf("answer function for %s was set by another VU", req.Command)
+	}
+	v, err := spec.fn(sobek.Undefined(), rt.ToValue(req.snapshot()))
+	if err != nil {
+		return options, err
+	}
+	if !sobek.IsUndefined(v) && !sobek.IsNull(v) {
+		if err := rt.ExportTo(v, &options); err != nil {
+			return options, errors.WithMessage(err, "invalid answer")
+		}
+	}
+	if err := appendAVPs(diam.NewMessage(req.msg.Header.CommandCode, 0, req.AppId, 0, 0, dict.Default), nil, options.Avps); err != nil {
+		return options, errors.WithMessage(err, "invalid answer")
+	}
+	return options, nil
+}
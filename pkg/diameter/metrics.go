@@ -0,0 +1,335 @@
+package diameter
+
+import (
+	"crypto/tls"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.k6.io/k6/metrics"
+)
+
+type diameterMetrics struct {
+	RequestDuration *metrics.Metric
+	Requests        *metrics.Metric
+	FailedRequests  *metrics.Metric
+	Timeouts        *metrics.Metric
+	LateAnswers     *metrics.Metric
+
+	WatchdogDuration *metrics.Metric
+	WatchdogFailures *metrics.Metric
+
+	PeerUp   *metrics.Metric
+	PeerDown *metrics.Metric
+
+	TLSHandshakeDuration *metrics.Metric
+}
+
+func registerMetrics(registry *metrics.Registry) (*diameterMetrics, error) {
+	var err error
+	m := &diameterMetrics{}
+	if m.RequestDuration, err = registry.NewMetric("diameter_req_duration", metrics.Trend, metrics.Time); err != nil {
+		return nil, err
+	}
+	if m.Requests, err = registry.NewMetric("diameter_reqs", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.FailedRequests, err = registry.NewMetric("diameter_failed_reqs", metrics.Rate); err != nil {
+		return nil, err
+	}
+	if m.Timeouts, err = registry.NewMetric("diameter_timeouts", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.LateAnswers, err = registry.NewMetric("diameter_late_answers", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.WatchdogDuration, err = registry.NewMetric("diameter_watchdog_duration", metrics.Trend, metrics.Time); err != nil {
+		return nil, err
+	}
+	if m.WatchdogFailures, err = registry.NewMetric("diameter_watchdog_failures", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.PeerUp, err = registry.NewMetric("diameter_peer_up", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.PeerDown, err = registry.NewMetric("diameter_peer_down", metrics.Counter); err != nil {
+		return nil, err
+	}
+	if m.TLSHandshakeDuration, err = registry.NewMetric("diameter_tls_handshake_duration", metrics.Trend, metrics.Time); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// exchange describes one request/answer round trip for metric reporting.
+type exchange struct {
+	Command                string
+	AppID                  uint32
+	Peer                   string
+	Start                  time.Time
+	ResultCode             uint32
+	ExperimentalResultCode uint32
+	Timeout                bool
+}
+
+// failed reports whether the answer did not carry a 2xxx result.
+func (e exchange) failed() bool {
+	if e.Timeout {
+		return true
+	}
+	if e.ResultCode != 0 {
+		return !isSuccess(e.ResultCode)
+	}
+	return !isSuccess(e.ExperimentalResultCode)
+}
+
+func isSuccess(code uint32) bool {
+	return code >= 2000 && code < 3000
+}
+
+func (c *K6DiameterClient) reportExchange(e exchange) {
+	if c.metrics == nil {
+		return
+	}
+	state := c.vu.State()
+	if state == nil {
+		return
+	}
+	now := time.Now()
+	ctm := state.Tags.GetCurrentValues()
+	tags := ctm.Tags.
+		With("command", e.Command).
+		With("app_id", strconv.FormatUint(uint64(e.AppID), 10)).
+		With("peer", e.Peer).
+		With("origin_host", c.originHost())
+	if !e.Timeout {
+		tags = tags.
+			With("result_code", strconv.FormatUint(uint64(e.ResultCode), 10)).
+			With("experimental_result_code", strconv.FormatUint(uint64(e.ExperimentalResultCode), 10))
+	}
+
+	failed := 0.0
+	if e.failed() {
+		failed = 1.0
+	}
+	samples := []metrics.Sample{
+		{
+			TimeSeries: metrics.TimeSeries{Metric: c.metrics.Requests, Tags: tags},
+			Time:       now,
+			Metadata:   ctm.Metadata,
+			Value:      1,
+		},
+		{
+			TimeSeries: metrics.TimeSeries{Metric: c.metrics.FailedRequests, Tags: tags},
+			Time:       now,
+			Metadata:   ctm.Metadata,
+			Value:      failed,
+		},
+	}
+	if e.Timeout {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: c.metrics.Timeouts, Tags: tags},
+			Time:       now,
+			Metadata:   ctm.Metadata,
+			Value:      1,
+		})
+	} else {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: c.metrics.RequestDuration, Tags: tags},
+			Time:       now,
+			Metadata:   ctm.Metadata,
+			Value:      metrics.D(now.Sub(e.Start)),
+		})
+	}
+	c.pushSamples(samples, tags, now)
+}
+
+// reportSent reports a request sent without waiting for its answer, which
+// only counts in diameter_reqs.
+func (c *K6DiameterClient) reportSent(command string, appID uint32) {
+	if c.metrics == nil {
+		return
+	}
+	state := c.vu.State()
+	if state == nil {
+		return
+	}
+	now := time.Now()
+	ctm := state.Tags.GetCurrentValues()
+	tags := ctm.Tags.
+		With("command", command).
+		With("app_id", strconv.FormatUint(uint64(appID), 10)).
+		With("peer", c.peerHost()).
+		With("origin_host", c.originHost())
+	c.pushSamples([]metrics.Sample{{
+		TimeSeries: metrics.TimeSeries{Metric: c.metrics.Requests, Tags: tags},
+		Time:       now,
+		Metadata:   ctm.Metadata,
+		Value:      1,
+	}}, tags, now)
+}
+
+// reportLateAnswer reports an answer that was discarded as it matched no
+// outstanding request, as soon as it is received.
+func (c *K6DiameterClient) reportLateAnswer() {
+	if c.metrics == nil {
+		return
+	}
+	c.pushBackground(c.metrics.LateAnswers, 1, func(tags *metrics.TagSet) *metrics.TagSet {
+		return tags.With("peer", c.peerHost()).With("origin_host", c.originHost())
+	})
+}
+
+// reportWatchdog reports the DWR/DWA round trip that started at start.
+func (c *K6DiameterClient) reportWatchdog(start time.Time, err error) {
+	if c.metrics == nil {
+		return
+	}
+	metric, value := c.metrics.WatchdogDuration, metrics.D(time.Since(start))
+	if err != nil {
+		metric, value = c.metrics.WatchdogFailures, 1
+	}
+	c.pushBackground(metric, value, func(tags *metrics.TagSet) *metrics.TagSet {
+		return tags.With("peer", c.peerHost()).With("origin_host", c.originHost())
+	})
+}
+
+// reportPeer reports the connection to the peer at addr going up or down.
+func (c *K6DiameterClient) reportPeer(up bool, addr string) {
+	if c.metrics == nil {
+		return
+	}
+	metric := c.metrics.PeerDown
+	if up {
+		metric = c.metrics.PeerUp
+	}
+	c.pushBackground(metric, 1, func(tags *metrics.TagSet) *metrics.TagSet {
+		return tags.With("addr", addr).With("origin_host", c.originHost())
+	})
+}
+
+// reportTLSHandshake reports the TLS handshake with the peer at addr that
+// started at start.
+func (c *K6DiameterClient) reportTLSHandshake(start time.Time, addr string, version uint16) {
+	if c.metrics == nil {
+		return
+	}
+	value := metrics.D(time.Since(start))
+	c.pushBackground(c.metrics.TLSHandshakeDuration, value, func(tags *metrics.TagSet) *metrics.TagSet {
+		return tags.With("addr", addr).With("tls_version", tls.VersionName(version))
+	})
+}
+
+// originHost returns the Origin-Host the client connects as, which tells the
+// simulated peers apart.
+func (c *K6DiameterClient) originHost() string {
+	if c.cfg == nil {
+		return ""
+	}
+	return string(c.cfg.OriginHost)
+}
+
+// pushSamples pushes samples reported from the VU goroutine, which also
+// hands the samples channel of the VU over to the module's sink.
+func (c *K6DiameterClient) pushSamples(samples []metrics.Sample, tags *metrics.TagSet, now time.Time) {
+	state := c.vu.State()
+	if c.rm != nil {
+		c.rm.samples.attach(state.Samples)
+	}
+	metrics.PushIfNotDone(c.vu.Context(), state.Samples, metrics.ConnectedSamples{
+		Samples: samples,
+		Tags:    tags,
+		Time:    now,
+	})
+}
+
+// pushBackground pushes a sample reported outside of the VU goroutine, e.g.
+// by the watchdog or the reader of a pooled connection, through the module's
+// sink rather than through the state of the VU that connected the client.
+func (c *K6DiameterClient) pushBackground(metric *metrics.Metric, value float64, tag func(*metrics.TagSet) *metrics.TagSet) {
+	if c.rm == nil {
+		return
+	}
+	c.rm.samples.push(metric, value, tag)
+}
+
+// sampleQueueSize bounds the samples reported outside of the VUs that wait
+// for the module's sink to be attached or drained.
+const sampleQueueSize = 1024
+
+// sampleSink forwards the samples reported outside of the VUs to the samples
+// channel of k6. There is no such channel in the init context, where pooled
+// clients connect, so samples are queued until the first VU pushes its own
+// samples and hands the channel over. Forwarding stops when the test ends.
+type sampleSink struct {
+	queue chan metrics.SampleContainer
+	done  chan struct{}
+
+	tagsOnce sync.Once
+	tags     *metrics.TagSet
+
+	attachOnce sync.Once
+	closeOnce  sync.Once
+}
+
+func newSampleSink() *sampleSink {
+	return &sampleSink{
+		queue: make(chan metrics.SampleContainer, sampleQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// setTags sets the tags of the test every sample starts from.
+func (s *sampleSink) setTags(registry *metrics.Registry) {
+	s.tagsOnce.Do(func() { s.tags = registry.RootTagSet() })
+}
+
+// attach starts forwarding the queued samples to out.
+func (s *sampleSink) attach(out chan<- metrics.SampleContainer) {
+	s.attachOnce.Do(func() { go s.forward(out) })
+}
+
+func (s *sampleSink) forward(out chan<- metrics.SampleContainer) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case samples := <-s.queue:
+			select {
+			case out <- samples:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// push queues a sample of metric, tagged by tag, dropping it once the test
+// ended or the queue is full.
+func (s *sampleSink) push(metric *metrics.Metric, value float64, tag func(*metrics.TagSet) *metrics.TagSet) {
+	tags := s.tags
+	if tags == nil {
+		return
+	}
+	tags = tag(tags)
+	now := time.Now()
+	samples := metrics.ConnectedSamples{
+		Samples: []metrics.Sample{{
+			TimeSeries: metrics.TimeSeries{Metric: metric, Tags: tags},
+			Time:       now,
+			Value:      value,
+		}},
+		Tags: tags,
+		Time: now,
+	}
+	select {
+	case <-s.done:
+	case s.queue <- samples:
+	default:
+	}
+}
+
+// close stops forwarding at the end of the test.
+func (s *sampleSink) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
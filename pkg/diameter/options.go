@@ -0,0 +1,201 @@
+package diameter
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+	"go.k6.io/k6/js/common"
+)
+
+// optionAliases are keys accepted for backward compatibility.
+var optionAliases = map[string]string{
+	"hostipaddresses": "host_ip_addresses",
+}
+
+// exportOptions parses the options object v of a script into out.
+func exportOptions(v sobek.Value, out interface{}) error {
+	var exported interface{}
+	if v != nil {
+		exported = v.Export()
+	}
+	return decodeOptions(exported, out)
+}
+
+func parseConnectionOptions(v sobek.Value) (ConnectionOptions, error) {
+	var co ConnectionOptions
+	err := exportOptions(v, &co)
+	return co, err
+}
+
+func parseRequestOptions(v sobek.Value) (RequestOptions, error) {
+	var ro RequestOptions
+	err := exportOptions(v, &ro)
+	return ro, err
+}
+
+func parseCxRequestOptions(v sobek.Value) (CxRequestOptions, error) {
+	var co CxRequestOptions
+	err := exportOptions(v, &co)
+	return co, err
+}
+
+// decodeOptions decodes the exported JS value v into the struct pointed to
+// by out. Keys name the fields as k6 does for JS (snake_case), and unknown
+// keys and values of the wrong type are errors. Null and undefined values
+// leave their field unset, so pointer fields tell unset from empty.
+func decodeOptions(v, out interface{}) error {
+	return decodeOption("", v, reflect.ValueOf(out).Elem())
+}
+
+func decodeOption(path string, v interface{}, dst reflect.Value) error {
+	if v == nil {
+		return nil
+	}
+	typ := dst.Type()
+	switch typ.Kind() {
+	case reflect.Interface:
+		dst.Set(reflect.ValueOf(v))
+		return nil
+	case reflect.Ptr:
+		elem := reflect.New(typ.Elem())
+		if err := decodeOption(path, v, elem.Elem()); err != nil {
+			return err
+		}
+		dst.Set(elem)
+		return nil
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return invalidOption(path, "an object", v)
+		}
+		fields := optionFields(typ)
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := m[key]
+			if alias, ok := optionAliases[key]; ok {
+				key = alias
+			}
+			index, ok := fields[key]
+			if !ok {
+				return errors.Errorf("unknown option %q", joinPath(path, key))
+			}
+			if err := decodeOption(joinPath(path, key), value, dst.FieldByIndex(index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		// Byte slices, e.g. DiameterIdentity, are set from strings.
+		if typ.Elem().Kind() == reflect.Uint8 {
+			s, ok := v.(string)
+			if !ok {
+				return invalidOption(path, "a string", v)
+			}
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return invalidOption(path, "an array", v)
+		}
+		s := reflect.MakeSlice(typ, len(list), len(list))
+		for i, e := range list {
+			if err := decodeOption(fmt.Sprintf("%s[%d]", path, i), e, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+		return nil
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return invalidOption(path, "a string", v)
+		}
+		dst.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return invalidOption(path, "a boolean", v)
+		}
+		dst.SetBool(b)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := optionInteger(v)
+		if !ok || n < 0 || dst.OverflowUint(uint64(n)) {
+			return invalidOption(path, "a non-negative integer", v)
+		}
+		dst.SetUint(uint64(n))
+		return nil
+	}
+	return errors.Errorf("option %s has an unsupported type %s", path, typ)
+}
+
+// optionFields maps the JS names of the fields of typ, including the fields
+// of embedded structs, to their index.
+func optionFields(typ reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for name, index := range optionFields(f.Type) {
+				fields[name] = append([]int{i}, index...)
+			}
+			continue
+		}
+		fields[common.FieldName(typ, f)] = []int{i}
+	}
+	return fields
+}
+
+// optionInteger returns v as an integer if it is an integral number.
+func optionInteger(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n <= math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func invalidOption(path, want string, v interface{}) error {
+	return errors.Errorf("invalid option %s: want %s, got %s", path, want, jsTypeOf(v))
+}
+
+// jsTypeOf describes the exported JS value v in errors.
+func jsTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case int64, float64:
+		return fmt.Sprintf("number %v", v)
+	case bool:
+		return fmt.Sprintf("boolean %v", v)
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
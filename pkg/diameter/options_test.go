@@ -0,0 +1,155 @@
+package diameter
+
+import (
+	"testing"
+)
+
+func TestDecodeOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input map[string]interface{}
+		want  func(ConnectionOptions) bool
+	}{
+		{
+			name:  "snake case keys",
+			input: map[string]interface{}{"addr": "localhost:3868", "app_id": int64(16777251), "completion_sleep": float64(5)},
+			want: func(o ConnectionOptions) bool {
+				return o.Addr == "localhost:3868" && o.AppId == 16777251 && o.CompletionSleep == 5
+			},
+		},
+		{
+			name:  "alias",
+			input: map[string]interface{}{"hostipaddresses": []interface{}{"127.0.0.1"}},
+			want: func(o ConnectionOptions) bool {
+				return len(o.HostIPAddresses) == 1 && o.HostIPAddresses[0] == "127.0.0.1"
+			},
+		},
+		{
+			name:  "null leaves pointers unset",
+			input: map[string]interface{}{"tls": nil, "pur_flags": nil},
+			want: func(o ConnectionOptions) bool {
+				return o.TLS == nil && o.PurFlags == nil
+			},
+		},
+		{
+			name:  "empty object sets pointers",
+			input: map[string]interface{}{"tls": map[string]interface{}{}, "pur_flags": int64(0)},
+			want: func(o ConnectionOptions) bool {
+				return o.TLS != nil && o.PurFlags != nil && *o.PurFlags == 0
+			},
+		},
+		{
+			name:  "nested",
+			input: map[string]interface{}{"sctp": map[string]interface{}{"ostreams": int64(4)}},
+			want: func(o ConnectionOptions) bool {
+				return o.SCTP != nil && o.SCTP.Ostreams == 4
+			},
+		},
+		{
+			name:  "byte slice from string",
+			input: map[string]interface{}{"destination_host": "hss.example.com"},
+			want: func(o ConnectionOptions) bool {
+				return o.DestinationHost != nil && string(*o.DestinationHost) == "hss.example.com"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var o ConnectionOptions
+			if err := decodeOptions(tt.input, &o); err != nil {
+				t.Fatalf("decodeOptions() error = %v", err)
+			}
+			if !tt.want(o) {
+				t.Errorf("decodeOptions() = %+v", o)
+			}
+		})
+	}
+}
+
+func TestDecodeOptionsErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input interface{}
+		want  string
+	}{
+		{
+			name:  "unknown key",
+			input: map[string]interface{}{"adr": "localhost:3868"},
+			want:  `unknown option "adr"`,
+		},
+		{
+			name:  "unknown nested key",
+			input: map[string]interface{}{"tls": map[string]interface{}{"certificate": "x"}},
+			want:  `unknown option "tls.certificate"`,
+		},
+		{
+			name:  "fractional integer",
+			input: map[string]interface{}{"retries": 1.5},
+			want:  "invalid option retries: want a non-negative integer, got number 1.5",
+		},
+		{
+			name:  "negative integer",
+			input: map[string]interface{}{"retries": int64(-1)},
+			want:  "invalid option retries: want a non-negative integer, got number -1",
+		},
+		{
+			name:  "number for string",
+			input: map[string]interface{}{"tls": map[string]interface{}{"ca": int64(3)}},
+			want:  "invalid option tls.ca: want a string, got number 3",
+		},
+		{
+			name:  "string for integer",
+			input: map[string]interface{}{"app_id": "16777251"},
+			want:  `invalid option app_id: want a non-negative integer, got string "16777251"`,
+		},
+		{
+			name:  "string for boolean",
+			input: map[string]interface{}{"reconnect": "true"},
+			want:  `invalid option reconnect: want a boolean, got string "true"`,
+		},
+		{
+			name:  "object for array",
+			input: map[string]interface{}{"local_addrs": map[string]interface{}{}},
+			want:  "invalid option local_addrs: want an array, got object",
+		},
+		{
+			name:  "array element",
+			input: map[string]interface{}{"applications": []interface{}{map[string]interface{}{"app_id": true}}},
+			want:  "invalid option applications[0].app_id: want a non-negative integer, got boolean true",
+		},
+		{
+			name:  "not an object",
+			input: "localhost:3868",
+			want:  `invalid option : want an object, got string "localhost:3868"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var o ConnectionOptions
+			err := decodeOptions(tt.input, &o)
+			if err == nil {
+				t.Fatalf("decodeOptions() = %+v, want error %q", o, tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("decodeOptions() error = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOptionsOverflow(t *testing.T) {
+	t.Parallel()
+
+	var o struct{ Streams uint16 }
+	err := decodeOptions(map[string]interface{}{"streams": int64(1 << 16)}, &o)
+	want := "invalid option streams: want a non-negative integer, got number 65536"
+	if err == nil || err.Error() != want {
+		t.Errorf("decodeOptions() error = %v, want %q", err, want)
+	}
+}
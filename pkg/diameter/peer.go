@@ -0,0 +1,325 @@
+package diameter
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.k6.io/k6/js/modules"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Peer states, after RFC 6733 section 5.6. Wait-Conn-Ack covers both the
+// transport connection and the capabilities exchange.
+const (
+	peerClosed      = "Closed"
+	peerWaitConnAck = "Wait-Conn-Ack"
+	peerOpen        = "I-Open"
+	peerClosing     = "Closing"
+)
+
+const (
+	defaultReconnectBackoff    = 1 * time.Second
+	defaultReconnectMaxBackoff = 30 * time.Second
+	defaultDisconnectTimeout   = 3 * time.Second
+)
+
+// testEndEvent is event.TestEnd, whose package is internal to k6.
+const testEndEvent = 3
+
+// link holds the connection to the peer and its state. It is shared by the
+// views of a pooled client, so that a reconnection is seen by all of them.
+type link struct {
+	mu      sync.RWMutex
+	conn    diam.Conn
+	addr    string
+	cea     *CapabilitiesExchange
+	state   string
+	closing bool
+	done    chan struct{}
+}
+
+func newLink() *link {
+	return &link{
+		state: peerClosed,
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *link) get() diam.Conn {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.conn
+}
+
+func (l *link) status() (state, addr string) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.state, l.addr
+}
+
+func (l *link) setState(state string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closing {
+		l.state = state
+	}
+}
+
+func (l *link) capabilities() *CapabilitiesExchange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cea
+}
+
+// open makes conn the connection to the peer. It reports false, and the
+// caller must close conn, when the link was closed meanwhile.
+func (l *link) open(conn diam.Conn, addr string, cea *CapabilitiesExchange) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.conn = conn
+	l.addr = addr
+	l.cea = cea
+	l.state = peerOpen
+	return true
+}
+
+// close stops reconnecting and returns the connection, which the caller
+// closes once the peer has been disconnected.
+func (l *link) close() diam.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return nil
+	}
+	l.closing = true
+	l.state = peerClosing
+	close(l.done)
+	return l.conn
+}
+
+// ready returns an error unless requests can be sent to the peer.
+func (l *link) ready() error {
+	state, addr := l.status()
+	if state != peerOpen {
+		return errors.Errorf("peer %s is %s", addr, state)
+	}
+	return nil
+}
+
+// addrs returns the address of the peer followed by its alternates.
+func (c *K6DiameterClient) addrs() []string {
+	return append([]string{c.options.Addr}, c.options.AlternateAddrs...)
+}
+
+// reconnects reports whether a lost connection is established again.
+func (c *K6DiameterClient) reconnects() bool {
+	return c.options.Reconnect || c.watchdog != nil && c.watchdog.policy == watchdogReconnect
+}
+
+// connectAny connects to the first of the peer addresses that accepts. When
+// none does and a peer rejected the capabilities exchange, its
+// ErrCEARejected is returned.
+func (c *K6DiameterClient) connectAny(l *link) error {
+	var errs []error
+	var rejected *ErrCEARejected
+	for _, addr := range c.addrs() {
+		l.setState(peerWaitConnAck)
+		conn, cea, err := c.dial(addr)
+		if err != nil {
+			if rejected == nil {
+				errors.As(err, &rejected)
+			}
+			errs = append(errs, errors.WithMessage(err, addr))
+			continue
+		}
+		if !l.open(conn, addr, cea) {
+			conn.Close()
+			return errors.New("closed while connecting")
+		}
+		c.reportPeer(true, addr)
+		return nil
+	}
+	l.setState(peerClosed)
+	if rejected != nil {
+		return rejected
+	}
+	return errors.Errorf("%v", errs)
+}
+
+// supervise waits for the connection to the peer to be lost, and
+// establishes it again if the client reconnects.
+func (c *K6DiameterClient) supervise(l *link) {
+	for {
+		notifier, ok := l.get().(diam.CloseNotifier)
+		if !ok {
+			return
+		}
+		select {
+		case <-l.done:
+			return
+		case <-notifier.CloseNotify():
+		}
+
+		_, addr := l.status()
+		l.setState(peerClosed)
+		c.pending.abort()
+		c.reportPeer(false, addr)
+		if !c.reconnects() || !c.reconnect(l, addr) {
+			return
+		}
+	}
+}
+
+// reconnect tries the peer addresses in turn, starting with the last one
+// used, backing off between attempts. It reports false when the link was
+// closed before a connection was established.
+func (c *K6DiameterClient) reconnect(l *link, last string) bool {
+	addrs := c.addrs()
+	start := 0
+	for i, addr := range addrs {
+		if addr == last {
+			start = i
+		}
+	}
+	backoff := defaultReconnectBackoff
+	if c.options.ReconnectBackoff > 0 {
+		backoff = time.Duration(c.options.ReconnectBackoff) * time.Second
+	}
+	maxBackoff := defaultReconnectMaxBackoff
+	if c.options.ReconnectMaxBackoff > 0 {
+		maxBackoff = time.Duration(c.options.ReconnectMaxBackoff) * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		addr := addrs[(start+attempt)%len(addrs)]
+		l.setState(peerWaitConnAck)
+		conn, cea, err := c.dial(addr)
+		if err == nil {
+			if !l.open(conn, addr, cea) {
+				conn.Close()
+				return false
+			}
+			c.reportPeer(true, addr)
+			return true
+		}
+		log.Println(errors.WithMessagef(err, "reconnect to %s", addr))
+		l.setState(peerClosed)
+
+		// Equal jitter, so that VUs do not reconnect in lockstep
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-l.done:
+			return false
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// State returns the state of the connection to the peer.
+func (c *K6DiameterClient) State() string {
+	if c.link == nil {
+		return peerClosed
+	}
+	state, _ := c.link.status()
+	return state
+}
+
+// Peer describes the peer from its CEA, and the state of the connection to
+// it.
+type Peer struct {
+	Addr               string
+	State              string
+	ResultCode         uint32
+	OriginHost         string
+	OriginRealm        string
+	HostIPAddresses    []string
+	VendorId           uint32
+	ProductName        string
+	Applications       []ApplicationOptions
+	CommonApplications []uint32
+}
+
+// Peer returns the peer the client is connected to, or null before Connect.
+func (c *K6DiameterClient) Peer() *Peer {
+	if c.link == nil {
+		return nil
+	}
+	cea := c.link.capabilities()
+	if cea == nil {
+		return nil
+	}
+	state, addr := c.link.status()
+	return &Peer{
+		Addr:               addr,
+		State:              state,
+		ResultCode:         cea.ResultCode,
+		OriginHost:         cea.OriginHost,
+		OriginRealm:        cea.OriginRealm,
+		HostIPAddresses:    cea.HostIPAddresses,
+		VendorId:           cea.VendorId,
+		ProductName:        cea.ProductName,
+		Applications:       cea.Applications,
+		CommonApplications: cea.CommonApplications,
+	}
+}
+
+// disconnect sends a Disconnect-Peer-Request and waits for its answer.
+func (c *K6DiameterClient) disconnect() error {
+	m := diam.NewRequest(diam.DisconnectPeer, 0, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, c.cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, c.cfg.OriginRealm)
+	m.NewAVP(avp.DisconnectCause, avp.Mbit, 0, datatype.Enumerated(c.options.DisconnectCause))
+	timeout := defaultDisconnectTimeout
+	if c.options.DisconnectTimeout > 0 {
+		timeout = time.Duration(c.options.DisconnectTimeout) * time.Second
+	}
+	if _, err := c.roundTrip(m, timeout); err != nil {
+		return errors.WithMessage(err, "Disconnect-Peer")
+	}
+	return nil
+}
+
+// closeOnTestEnd disconnects the clients still connected, including the
+// pooled ones and the simulated peers, when the test ends.
+func (rm *RootModule) closeOnTestEnd(vu modules.VU) {
+	events := vu.Events().Global
+	if events == nil {
+		return
+	}
+	sid, ch := events.Subscribe(testEndEvent)
+	go func() {
+		e, ok := <-ch
+		if !ok {
+			return
+		}
+		defer e.Done()
+		defer events.Unsubscribe(sid)
+		var wg sync.WaitGroup
+		rm.clients.Range(func(_, cli any) bool {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cli.(*K6DiameterClient).Close()
+			}()
+			return true
+		})
+		wg.Wait()
+		// The pools and peer groups are closed with their clients.
+		rm.mu.Lock()
+		rm.dialPool.Clear()
+		rm.peerGroups.Clear()
+		rm.mu.Unlock()
+		rm.samples.close()
+	}()
+}
@@ -0,0 +1,88 @@
+package diameter
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// peerTemplate is replaced by the peer number in Host and Realm.
+const peerTemplate = "{n}"
+
+// peerConnectConcurrency bounds the peers connecting at once.
+const peerConnectConcurrency = 64
+
+// peerGroup is a set of simulated peers, each with its own identity and
+// pool of connections. VUs are spread across the peers in turn. The group
+// lives until the end of the test, when its connections are closed.
+type peerGroup struct {
+	pools []*connPool
+	next  atomic.Uint64
+}
+
+// forPeer returns the options of the peer numbered n, from 1: the Host and
+// Realm templates are expanded and the peers take turns on LocalAddrs.
+func (co ConnectionOptions) forPeer(n int) ConnectionOptions {
+	co.Host = strings.ReplaceAll(co.Host, peerTemplate, strconv.Itoa(n))
+	co.Realm = strings.ReplaceAll(co.Realm, peerTemplate, strconv.Itoa(n))
+	if len(co.LocalAddrs) > 0 {
+		co.LocalAddr = co.LocalAddrs[(n-1)%len(co.LocalAddrs)]
+	}
+	co.Peers = 0
+	co.LocalAddrs = nil
+	return co
+}
+
+// connectPeers connects the Peers simulated peers of options.
+func (rm *RootModule) connectPeers(mi *ModuleInstance, options ConnectionOptions) (*peerGroup, error) {
+	if options.Peers > 1 && !strings.Contains(options.Host, peerTemplate) {
+		return nil, errors.Errorf("host must contain %s to give each of the %d peers its own identity", peerTemplate, options.Peers)
+	}
+	g := &peerGroup{pools: make([]*connPool, options.Peers)}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, peerConnectConcurrency)
+	for i := range g.pools {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			peer := options.forPeer(i + 1)
+			p, err := rm.connectPool(mi, peer)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, errors.WithMessage(err, peer.Host))
+				mu.Unlock()
+				return
+			}
+			g.pools[i] = p
+		}(i)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		g.close()
+		return nil, errors.Errorf("%d of %d peers failed to connect: %v", len(errs), len(g.pools), errs)
+	}
+	return g, nil
+}
+
+// pick returns the pool of the next VU.
+func (g *peerGroup) pick() *connPool {
+	n := g.next.Add(1) - 1
+	return g.pools[n%uint64(len(g.pools))]
+}
+
+func (g *peerGroup) close() {
+	for _, p := range g.pools {
+		if p != nil {
+			p.close()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package diameter
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Pool selection policies.
+const (
+	poolRoundRobin       = "round_robin"
+	poolLeastOutstanding = "least_outstanding"
+)
+
+// connPool is a set of connections to the same peer shared by the VUs of
+// K6DiameterClientWithConnect. Each request is sent on one connection
+// chosen by the pool policy.
+type connPool struct {
+	key     string
+	policy  string
+	clients []*K6DiameterClient
+	next    atomic.Uint64
+}
+
+func parsePoolPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return poolRoundRobin, nil
+	case poolRoundRobin, poolLeastOutstanding:
+		return policy, nil
+	}
+	return "", errors.Errorf("invalid pool_policy %q: want %s or %s",
+		policy, poolRoundRobin, poolLeastOutstanding)
+}
+
+// poolKey identifies the connections that can be shared: the same origin
+// host connected to the same peer over the same transport, advertising the
+// same applications, from the same local addresses, with the same pool size
+// and policy and the same TLS and SCTP options.
+func poolKey(options ConnectionOptions) string {
+	return fmt.Sprintf("%s|%s|%s|%v|%d|%s|%s|%v|%+v|%+v",
+		options.Host, options.Addr, transport(options), options.applications(),
+		options.PoolSize, options.PoolPolicy, options.LocalAddr, options.LocalAddrs,
+		options.TLS, options.SCTP)
+}
+
+func transport(options ConnectionOptions) string {
+	network := defaultNetwork(options.NetworkType)
+	switch {
+	case options.InbandSecurityId == inbandSecurityTLS:
+		return network + "+inband-tls"
+	case options.TLS != nil:
+		return network + "+tls"
+	}
+	return network
+}
+
+// connectPool connects PoolSize clients to the peer of options. The clients
+// share how requests from the peer are answered.
+func (rm *RootModule) connectPool(mi *ModuleInstance, options ConnectionOptions) (*connPool, error) {
+	policy, err := parsePoolPolicy(options.PoolPolicy)
+	if err != nil {
+		return nil, err
+	}
+	size := int(options.PoolSize)
+	if size == 0 {
+		size = 1
+	}
+	p := &connPool{
+		key:    poolKey(options),
+		policy: policy,
+	}
+	var inbound *inboundTable
+	for i := 0; i < size; i++ {
+		cli := &K6DiameterClient{
+			vu:      mi.vu,
+			metrics: mi.metrics,
+			rm:      rm,
+		}
+		if _, err := cli.connect(options, inbound); err != nil {
+			p.close()
+			return nil, errors.WithMessagef(err, "pool connection %d", i+1)
+		}
+		inbound = cli.inbound
+		p.clients = append(p.clients, cli)
+	}
+	return p, nil
+}
+
+// pick returns the client to send the next request on. Clients that are not
+// ready, e.g. while reconnecting, are skipped unless none is.
+func (p *connPool) pick() *K6DiameterClient {
+	if p.policy == poolLeastOutstanding {
+		var best *K6DiameterClient
+		bestN := 0
+		for _, cli := range p.clients {
+			if !cli.ready() {
+				continue
+			}
+			if n := cli.pending.len(); best == nil || n < bestN {
+				best, bestN = cli, n
+			}
+		}
+		if best != nil {
+			return best
+		}
+		return p.clients[0]
+	}
+	n := p.next.Add(1) - 1
+	for i := range p.clients {
+		cli := p.clients[(n+uint64(i))%uint64(len(p.clients))]
+		if cli.ready() {
+			return cli
+		}
+	}
+	return p.clients[n%uint64(len(p.clients))]
+}
+
+func (p *connPool) close() {
+	for _, cli := range p.clients {
+		cli.Close()
+	}
+}
+
+// ready reports whether requests can be sent to the peer.
+func (c *K6DiameterClient) ready() bool {
+	if c.link == nil || c.link.ready() != nil {
+		return false
+	}
+	return c.watchdog == nil || !c.watchdog.failFast()
+}
+
+// pick returns the client to send a request on: c itself, or a connection
+// of its pool.
+func (c *K6DiameterClient) pick() *K6DiameterClient {
+	if c.pool == nil {
+		return c
+	}
+	return c.pool.pick().forVU(c.vu)
+}
@@ -0,0 +1,153 @@
+package diameter
+
+import (
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+func TestPoolKey(t *testing.T) {
+	t.Parallel()
+
+	base := ConnectionOptions{
+		Addr:     "hss.example.com:3868",
+		Host:     "mme.example.com",
+		Realm:    "example.com",
+		AppId:    diam.TGPP_S6A_APP_ID,
+		VendorId: vendorId3GPP,
+		PoolSize: 4,
+	}
+	tests := []struct {
+		name   string
+		modify func(*ConnectionOptions)
+		same   bool
+	}{
+		{"identical", func(*ConnectionOptions) {}, true},
+		{"request options", func(o *ConnectionOptions) { o.Ueimsi, o.CompletionSleep = "001010000000001", 5 }, true},
+		{"default network", func(o *ConnectionOptions) { o.NetworkType = "tcp" }, true},
+		{"host", func(o *ConnectionOptions) { o.Host = "mme2.example.com" }, false},
+		{"addr", func(o *ConnectionOptions) { o.Addr = "hss2.example.com:3868" }, false},
+		{"network", func(o *ConnectionOptions) { o.NetworkType = "sctp" }, false},
+		{"application", func(o *ConnectionOptions) { o.AppId = diam.GX_CHARGING_CONTROL_APP_ID }, false},
+		{"pool size", func(o *ConnectionOptions) { o.PoolSize = 8 }, false},
+		{"pool policy", func(o *ConnectionOptions) { o.PoolPolicy = poolLeastOutstanding }, false},
+		{"local addr", func(o *ConnectionOptions) { o.LocalAddr = "10.0.0.10" }, false},
+		{"local addrs", func(o *ConnectionOptions) { o.LocalAddrs = []string{"10.0.0.10"} }, false},
+		{"TLS", func(o *ConnectionOptions) { o.TLS = &TLSOptions{ServerName: "hss"} }, false},
+		{"in-band TLS", func(o *ConnectionOptions) { o.InbandSecurityId = inbandSecurityTLS }, false},
+		{"SCTP", func(o *ConnectionOptions) { o.SCTP = &SCTPOptions{Ostreams: 4} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			options := base
+			tt.modify(&options)
+			if same := poolKey(options) == poolKey(base); same != tt.same {
+				t.Errorf("poolKey() same = %v, want %v: %q", same, tt.same, poolKey(options))
+			}
+		})
+	}
+}
+
+// newTestPoolClient returns a pool client that is ready, or not, with
+// outstanding requests.
+func newTestPoolClient(ready bool, outstanding int) *K6DiameterClient {
+	l := newLink()
+	if ready {
+		l.state = peerOpen
+	}
+	c := &K6DiameterClient{link: l, pending: newPendingTable()}
+	for i := 0; i < outstanding; i++ {
+		c.pending.add(newTestRequest(uint32(i), uint32(i)))
+	}
+	return c
+}
+
+func TestPoolPick(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		policy  string
+		clients []*K6DiameterClient
+		want    []int
+	}{
+		{
+			name:    "round robin",
+			policy:  poolRoundRobin,
+			clients: []*K6DiameterClient{newTestPoolClient(true, 0), newTestPoolClient(true, 0), newTestPoolClient(true, 0)},
+			want:    []int{0, 1, 2, 0},
+		},
+		{
+			name:    "round robin skips not ready",
+			policy:  poolRoundRobin,
+			clients: []*K6DiameterClient{newTestPoolClient(true, 0), newTestPoolClient(false, 0), newTestPoolClient(true, 0)},
+			want:    []int{0, 2, 2, 0},
+		},
+		{
+			name:    "round robin none ready",
+			policy:  poolRoundRobin,
+			clients: []*K6DiameterClient{newTestPoolClient(false, 0), newTestPoolClient(false, 0)},
+			want:    []int{0, 1, 0},
+		},
+		{
+			name:    "least outstanding",
+			policy:  poolLeastOutstanding,
+			clients: []*K6DiameterClient{newTestPoolClient(true, 2), newTestPoolClient(true, 1), newTestPoolClient(true, 3)},
+			want:    []int{1, 1},
+		},
+		{
+			name:    "least outstanding skips not ready",
+			policy:  poolLeastOutstanding,
+			clients: []*K6DiameterClient{newTestPoolClient(true, 2), newTestPoolClient(false, 0)},
+			want:    []int{0},
+		},
+		{
+			name:    "least outstanding none ready",
+			policy:  poolLeastOutstanding,
+			clients: []*K6DiameterClient{newTestPoolClient(false, 2), newTestPoolClient(false, 0)},
+			want:    []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &connPool{policy: tt.policy, clients: tt.clients}
+			for i, want := range tt.want {
+				if got := p.pick(); got != tt.clients[want] {
+					t.Errorf("pick() #%d = client %d, want %d", i, indexOfClient(tt.clients, got), want)
+				}
+			}
+		})
+	}
+}
+
+func indexOfClient(clients []*K6DiameterClient, c *K6DiameterClient) int {
+	for i, e := range clients {
+		if e == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestParsePoolPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{"", poolRoundRobin, false},
+		{poolRoundRobin, poolRoundRobin, false},
+		{poolLeastOutstanding, poolLeastOutstanding, false},
+		{"random", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parsePoolPolicy(tt.policy)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePoolPolicy(%q) = %q, %v, want %q, error %v", tt.policy, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
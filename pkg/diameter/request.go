@@ -0,0 +1,138 @@
+package diameter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// RequestOptions describes a request built from the dictionary by Request.
+type RequestOptions struct {
+	ConnectionOptions
+
+	// Command is the dictionary name ("Purge-UE") or abbreviation ("PUR")
+	// of the command. Code is used instead when Command is empty.
+	Command string
+	Code    uint
+	Flags   RequestFlags
+	Avps    []AVP
+}
+
+type RequestFlags struct {
+	Proxiable     bool
+	Retransmitted bool
+}
+
+// Answer is the answer to a request sent by Request. Avps holds the AVPs
+// keyed by name and AvpList the same AVPs in order with their header fields.
+type Answer struct {
+	Command                string
+	AppId                  uint32
+	Flags                  uint8
+	HopByHopId             uint32
+	EndToEndId             uint32
+	ResultCode             uint32
+	ExperimentalResultCode uint32
+	Avps                   map[string]interface{}
+	AvpList                []*DecodedAVP
+}
+
+// Request sends an arbitrary request and waits for its answer.
+func (c *K6DiameterClient) Request(v sobek.Value) (*Answer, error) {
+	options, err := parseRequestOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.request(options)
+}
+
+func (c *K6DiameterClient) request(options RequestOptions) (*Answer, error) {
+	c = c.pick()
+	code, appID, err := resolveCommand(options.Command, options.Code, uint32(options.AppId))
+	if err != nil {
+		return nil, err
+	}
+	opts := options.ConnectionOptions
+	opts.ProxiableFlag = opts.ProxiableFlag || options.Flags.Proxiable
+	opts.Additional = append(append([]AVP{}, opts.Additional...), options.Avps...)
+
+	m, err := c.newRequest(code, appID, opts)
+	if err != nil {
+		return nil, err
+	}
+	if options.Flags.Retransmitted {
+		m.Header.CommandFlags |= diam.RetransmittedFlag
+	}
+	a, err := c.checkSendMessage(m, time.Duration(opts.CompletionSleep)*time.Second)
+	if errors.Is(err, errTimeout) {
+		return nil, errors.Errorf("%s timeout", commandName(appID, code))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAnswer(a), nil
+}
+
+func newAnswer(m *diam.Message) *Answer {
+	a := &Answer{
+		Command:    commandName(m.Header.ApplicationID, m.Header.CommandCode),
+		AppId:      m.Header.ApplicationID,
+		Flags:      m.Header.CommandFlags,
+		HopByHopId: m.Header.HopByHopID,
+		EndToEndId: m.Header.EndToEndID,
+	}
+	a.ResultCode, a.ExperimentalResultCode = resultCodes(m)
+	a.Avps, a.AvpList = decodeAVPs(m.Header.ApplicationID, m.AVP)
+	return a
+}
+
+// resolveCommand returns the command code and application id of the command
+// called name, or of code when name is empty. When appID is 0 the
+// application defining the command is used.
+func resolveCommand(name string, code uint, appID uint32) (uint32, uint32, error) {
+	if name == "" {
+		if code == 0 {
+			return 0, 0, errors.New("missing command")
+		}
+		if appID == 0 {
+			return 0, 0, errors.New("missing app_id")
+		}
+		return uint32(code), appID, nil
+	}
+	var fallback *dict.Command
+	for _, app := range dict.Default.Apps() {
+		if appID != 0 && app.ID != appID && app.ID != 0 {
+			continue
+		}
+		for _, cmd := range app.Command {
+			if !matchCommand(cmd, name) {
+				continue
+			}
+			switch {
+			case app.ID == appID:
+				return cmd.Code, appID, nil
+			case appID == 0 && app.ID != 0:
+				return cmd.Code, app.ID, nil
+			default:
+				fallback = cmd
+			}
+		}
+	}
+	if fallback != nil {
+		return fallback.Code, appID, nil
+	}
+	return 0, 0, &ErrNotFound{name}
+}
+
+// matchCommand reports whether name refers to cmd by its name ("Purge-UE"),
+// its request name ("Purge-UE-Request") or abbreviation ("PUR").
+func matchCommand(cmd *dict.Command, name string) bool {
+	return strings.EqualFold(cmd.Name, name) ||
+		strings.EqualFold(cmd.Name+"-Request", name) ||
+		strings.EqualFold(cmd.Short+"R", name)
+}
@@ -0,0 +1,255 @@
+package diameter
+
+import (
+	"net"
+	"sync"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// Rx-Request-Type values (TS 29.214 section 5.3.31).
+const (
+	rxInitialRequest = 0
+	rxUpdateRequest  = 1
+)
+
+// RxRequestOptions describes the Rx AVPs of an AA-Request (TS 29.214 section
+// 5.6.1), or the Termination-Cause and AVPs of a
+// Session-Termination-Request. Unset options leave their AVP out.
+type RxRequestOptions struct {
+	// SubscriptionIds defaults to the ueimsi of the session in the
+	// initial AA-Request.
+	SubscriptionIds         []SubscriptionID
+	FramedIpAddress         string
+	FramedIpv6Prefix        string
+	AfApplicationIdentifier string
+	AfChargingIdentifier    string
+	MediaComponents         []MediaComponent
+	SpecificActions         []uint
+	ServiceInfoStatus       *uint
+
+	// TerminationCause defaults to DIAMETER_LOGOUT in
+	// Session-Termination-Requests.
+	TerminationCause uint
+
+	Avps []AVP
+}
+
+// MediaComponent is a Media-Component-Description, a media stream of the
+// AF session.
+type MediaComponent struct {
+	Number                  uint
+	MediaType               *uint
+	FlowStatus              *uint
+	MaxRequestedBandwidthUl uint
+	MaxRequestedBandwidthDl uint
+	RrBandwidth             *uint
+	RsBandwidth             *uint
+	Codecs                  []string
+	SubComponents           []MediaSubComponent
+}
+
+// MediaSubComponent is a Media-Sub-Component, the IP flows of a media
+// stream described by IPFilterRules, e.g. "permit out 17 from 10.0.0.1 49152
+// to 10.45.0.2 50000".
+type MediaSubComponent struct {
+	FlowNumber       uint
+	FlowDescriptions []string
+	FlowUsage        *uint
+	FlowStatus       *uint
+}
+
+// RxSession is an AF session of the P-CSCF with the PCRF. Its first
+// AA-Request opens it, later ones modify it, and a
+// Session-Termination-Request terminates it. Re-Auth-Requests and
+// Abort-Session-Requests of the PCRF for the session are answered, and an
+// Abort-Session-Request marks it aborted.
+type RxSession struct {
+	SessionId string
+
+	s       *session
+	mu      sync.Mutex
+	aborted bool
+}
+
+// RxSession returns a new Rx session. Its requests carry options:
+// session_id, destination_host, destination_realm, additional AVPs,
+// completion_sleep as the answer timeout, and ueimsi as the default
+// Subscription-Id.
+func (c *K6DiameterClient) RxSession(v sobek.Value) (*RxSession, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSession(c, diam.RX_APP_ID, options)
+	if err != nil {
+		return nil, err
+	}
+	r := &RxSession{SessionId: s.id, s: s}
+	s.received = func(m *diam.Message) {
+		if m.Header.CommandCode == diam.AbortSession {
+			r.mu.Lock()
+			r.aborted = true
+			r.mu.Unlock()
+		}
+	}
+	return r, nil
+}
+
+// Authorize sends an AA-Request, the initial one of the session or one
+// modifying it.
+func (r *RxSession) Authorize(v sobek.Value) (*Answer, error) {
+	var options RxRequestOptions
+	if err := exportOptions(v, &options); err != nil {
+		return nil, err
+	}
+	// The AA-Request is the initial one until one is answered with success.
+	// Holding sending keeps the other requests of the session from changing
+	// the state in between.
+	r.s.sending.Lock()
+	defer r.s.sending.Unlock()
+	r.s.mu.Lock()
+	request, requestType := sessionUpdate, rxUpdateRequest
+	if r.s.state == sessionIdle {
+		request, requestType = sessionInitial, rxInitialRequest
+	}
+	r.s.mu.Unlock()
+	m, err := r.s.sendLocked(request, diam.AA, func() (ConnectionOptions, error) {
+		ueimsi := ""
+		if request == sessionInitial {
+			ueimsi = r.s.options.Ueimsi
+		}
+		avps, err := options.avps(ueimsi)
+		if err != nil {
+			return ConnectionOptions{}, err
+		}
+		return r.s.request(append([]AVP{
+			{Key: "Auth-Application-Id", Value: int64(diam.RX_APP_ID)},
+			{Key: "Rx-Request-Type", Value: int64(requestType)},
+		}, avps...)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newAnswer(m), nil
+}
+
+// Terminate sends the Session-Termination-Request of the session, e.g. when
+// the call ends or after the PCRF aborted the session.
+func (r *RxSession) Terminate(v sobek.Value) (*Answer, error) {
+	var options RxRequestOptions
+	if err := exportOptions(v, &options); err != nil {
+		return nil, err
+	}
+	cause := int64(options.TerminationCause)
+	if cause == 0 {
+		cause = terminationCauseLogout
+	}
+	m, err := r.s.send(sessionTermination, diam.SessionTermination, func() (ConnectionOptions, error) {
+		return r.s.request(append([]AVP{
+			{Key: "Auth-Application-Id", Value: int64(diam.RX_APP_ID)},
+			{Key: "Termination-Cause", Value: cause},
+		}, options.Avps...)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newAnswer(m), nil
+}
+
+// WaitRequest waits up to wait seconds for a request of the PCRF for the
+// session, a Re-Auth-Request or Abort-Session-Request.
+func (r *RxSession) WaitRequest(wait int64) (*InboundRequest, error) {
+	return r.s.waitRequest(wait)
+}
+
+// Aborted reports whether the PCRF sent an Abort-Session-Request for the
+// session.
+func (r *RxSession) Aborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// avps returns the AVPs of an AA-Request, with the Subscription-Id of the
+// IMSI ueimsi by default.
+func (o *RxRequestOptions) avps(ueimsi string) ([]AVP, error) {
+	var avps []AVP
+	if o.AfApplicationIdentifier != "" {
+		avps = append(avps, AVP{Key: "AF-Application-Identifier", Value: o.AfApplicationIdentifier})
+	}
+	for _, mc := range o.MediaComponents {
+		avps = append(avps, AVP{Key: "Media-Component-Description", Value: groupAVPs(mc.avps()...)})
+	}
+	if o.ServiceInfoStatus != nil {
+		avps = append(avps, AVP{Key: "Service-Info-Status", Value: int64(*o.ServiceInfoStatus)})
+	}
+	if o.AfChargingIdentifier != "" {
+		avps = append(avps, AVP{Key: "AF-Charging-Identifier", Value: o.AfChargingIdentifier})
+	}
+	for _, action := range o.SpecificActions {
+		avps = append(avps, AVP{Key: "Specific-Action", Value: int64(action)})
+	}
+	ids, err := subscriptionIDAVPs(o.SubscriptionIds, ueimsi)
+	if err != nil {
+		return nil, err
+	}
+	avps = append(avps, ids...)
+	if o.FramedIpAddress != "" {
+		ip := net.ParseIP(o.FramedIpAddress).To4()
+		if ip == nil {
+			return nil, errors.Errorf("invalid framed_ip_address `%s`", o.FramedIpAddress)
+		}
+		avps = append(avps, AVP{Key: "Framed-IP-Address", Value: string(ip)})
+	}
+	if o.FramedIpv6Prefix != "" {
+		avps = append(avps, AVP{Key: "Framed-IPv6-Prefix", Value: o.FramedIpv6Prefix})
+	}
+	return append(avps, o.Avps...), nil
+}
+
+func (mc *MediaComponent) avps() []AVP {
+	avps := []AVP{{Key: "Media-Component-Number", Value: int64(mc.Number)}}
+	for _, sub := range mc.SubComponents {
+		avps = append(avps, AVP{Key: "Media-Sub-Component", Value: groupAVPs(sub.avps()...)})
+	}
+	if mc.MediaType != nil {
+		avps = append(avps, AVP{Key: "Media-Type", Value: int64(*mc.MediaType)})
+	}
+	if mc.MaxRequestedBandwidthUl != 0 {
+		avps = append(avps, AVP{Key: "Max-Requested-Bandwidth-UL", Value: int64(mc.MaxRequestedBandwidthUl)})
+	}
+	if mc.MaxRequestedBandwidthDl != 0 {
+		avps = append(avps, AVP{Key: "Max-Requested-Bandwidth-DL", Value: int64(mc.MaxRequestedBandwidthDl)})
+	}
+	if mc.FlowStatus != nil {
+		avps = append(avps, AVP{Key: "Flow-Status", Value: int64(*mc.FlowStatus)})
+	}
+	if mc.RsBandwidth != nil {
+		avps = append(avps, AVP{Key: "RS-Bandwidth", Value: int64(*mc.RsBandwidth)})
+	}
+	if mc.RrBandwidth != nil {
+		avps = append(avps, AVP{Key: "RR-Bandwidth", Value: int64(*mc.RrBandwidth)})
+	}
+	for _, codec := range mc.Codecs {
+		avps = append(avps, AVP{Key: "Codec-Data", Value: codec})
+	}
+	return avps
+}
+
+func (sub *MediaSubComponent) avps() []AVP {
+	avps := []AVP{{Key: "Flow-Number", Value: int64(sub.FlowNumber)}}
+	for _, flow := range sub.FlowDescriptions {
+		avps = append(avps, AVP{Key: "Flow-Description", Value: flow})
+	}
+	if sub.FlowStatus != nil {
+		avps = append(avps, AVP{Key: "Flow-Status", Value: int64(*sub.FlowStatus)})
+	}
+	if sub.FlowUsage != nil {
+		avps = append(avps, AVP{Key: "Flow-Usage", Value: int64(*sub.FlowUsage)})
+	}
+	return avps
+}
@@ -0,0 +1,82 @@
+package diameter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+func TestRxSessionState(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t)
+	var mu sync.Mutex
+	aaResults := []uint32{diam.UnableToComply, diam.Success, diam.Success}
+	var requestTypes []uint32
+	peer.handle(diam.RX_APP_ID, diam.AA, func(m *diam.Message) uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+		if a, err := m.FindAVP(avp.RxRequestType, vendorId3GPP); err == nil {
+			requestTypes = append(requestTypes, uint32(a.Data.(datatype.Enumerated)))
+		}
+		resultCode := aaResults[0]
+		aaResults = aaResults[1:]
+		return resultCode
+	})
+	strResults := []uint32{diam.UnableToComply, diam.Success}
+	peer.handle(diam.RX_APP_ID, diam.SessionTermination, func(*diam.Message) uint32 {
+		resultCode := strResults[0]
+		strResults = strResults[1:]
+		return resultCode
+	})
+	c := peer.connect(t, diam.RX_APP_ID)
+	s, err := newSession(c, diam.RX_APP_ID, ConnectionOptions{CompletionSleep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RxSession{SessionId: s.id, s: s}
+
+	steps := []struct {
+		name       string
+		send       func() (*Answer, error)
+		resultCode uint32
+		want       sessionState
+	}{
+		{"rejected initial AAR", func() (*Answer, error) { return r.Authorize(nil) }, diam.UnableToComply, sessionIdle},
+		{"initial AAR", func() (*Answer, error) { return r.Authorize(nil) }, diam.Success, sessionOpen},
+		{"update AAR", func() (*Answer, error) { return r.Authorize(nil) }, diam.Success, sessionOpen},
+		{"rejected STR", func() (*Answer, error) { return r.Terminate(nil) }, diam.UnableToComply, sessionOpen},
+		{"STR", func() (*Answer, error) { return r.Terminate(nil) }, diam.Success, sessionTerminated},
+	}
+	for _, step := range steps {
+		a, err := step.send()
+		if err != nil {
+			t.Fatalf("%s: error = %v", step.name, err)
+		}
+		if a.ResultCode != step.resultCode {
+			t.Errorf("%s: Result-Code = %d, want %d", step.name, a.ResultCode, step.resultCode)
+		}
+		s.mu.Lock()
+		state := s.state
+		s.mu.Unlock()
+		if state != step.want {
+			t.Errorf("%s: state = %d, want %d", step.name, state, step.want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []uint32{rxInitialRequest, rxInitialRequest, rxUpdateRequest}
+	if len(requestTypes) != len(want) {
+		t.Fatalf("Rx-Request-Types = %v, want %v", requestTypes, want)
+	}
+	for i := range want {
+		if requestTypes[i] != want[i] {
+			t.Errorf("Rx-Request-Types = %v, want %v", requestTypes, want)
+			break
+		}
+	}
+}
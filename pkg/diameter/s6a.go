@@ -0,0 +1,276 @@
+package diameter
+
+import (
+	"sort"
+
+	"github.com/grafana/sobek"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// authSessionStateNoStateMaintained is the Auth-Session-State of S6a
+// sessions.
+const authSessionStateNoStateMaintained = 1
+
+// s6aFlags names the bits of the S6a flags AVPs (TS 29.272 section 7.3),
+// from bit 0. Reserved bits have no name.
+var s6aFlags = map[string][]string{
+	"ULR-Flags": {
+		"single_registration_indication",
+		"s6a_s6d_indicator",
+		"skip_subscriber_data",
+		"gprs_subscription_data_indicator",
+		"node_type_indicator",
+		"initial_attach_indicator",
+		"ps_lcs_not_supported_by_ue",
+		"sms_only_indication",
+	},
+	"ULA-Flags": {"separation_indication", "mme_registered_for_sms"},
+	"CLR-Flags": {"s6a_s6d_indicator", "reattach_required"},
+	"IDR-Flags": {
+		"ue_reachability_request",
+		"t_ads_data_request",
+		"eps_user_state_request",
+		"eps_location_information_request",
+		"current_location_request",
+		"local_time_zone_request",
+		"remove_sms_registration",
+		"rat_type_requested",
+		"pcscf_restoration_request",
+	},
+	"IDA-Flags": {"network_node_area_restricted"},
+	"DSA-Flags": {"network_node_area_restricted"},
+	"PUR-Flags": {"ue_purged_in_mme", "ue_purged_in_sgsn"},
+	"PUA-Flags": {"freeze_m_tmsi", "freeze_p_tmsi"},
+	"NOR-Flags": {
+		"single_registration_indication",
+		"sgsn_area_restricted",
+		"ready_for_sm_from_sgsn",
+		"ue_reachable_from_mme",
+		"",
+		"ue_reachable_from_sgsn",
+		"ready_for_sm_from_mme",
+		"homogeneous_support_of_ims_voice_over_ps_sessions",
+		"s6a_s6d_indicator",
+		"removal_of_mme_registration_for_sms",
+	},
+}
+
+func flagBits(name string) ([]string, error) {
+	bits, ok := s6aFlags[name]
+	if !ok {
+		names := make([]string, 0, len(s6aFlags))
+		for n := range s6aFlags {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown flags AVP `%s`, want one of %v", name, names)
+	}
+	return bits, nil
+}
+
+// Flags returns the value of the flags AVP name, e.g. PUR-Flags, with the
+// named bits set: flags("PUR-Flags", { ue_purged_in_mme: true }).
+func (mi *ModuleInstance) Flags(name string, set map[string]interface{}) (uint32, error) {
+	bits, err := flagBits(name)
+	if err != nil {
+		return 0, err
+	}
+	var flags uint32
+	for key, v := range set {
+		on, ok := v.(bool)
+		if !ok {
+			return 0, invalidOption(key, "a boolean", v)
+		}
+		bit := indexOf(bits, key)
+		if bit < 0 {
+			return 0, errors.Errorf("unknown %s bit `%s`, want one of %v", name, key, bitNames(bits))
+		}
+		if on {
+			flags |= 1 << bit
+		}
+	}
+	return flags, nil
+}
+
+// DecodeFlags returns the named bits of the value of the flags AVP name,
+// e.g. decodeFlags("ULA-Flags", ula.avps["ULA-Flags"]).
+func (mi *ModuleInstance) DecodeFlags(name string, value int64) (map[string]bool, error) {
+	bits, err := flagBits(name)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make(map[string]bool, len(bits))
+	for bit, key := range bits {
+		if key != "" {
+			decoded[key] = value&(1<<bit) != 0
+		}
+	}
+	return decoded, nil
+}
+
+// bitNames returns the names of the bits that are not reserved.
+func bitNames(bits []string) []string {
+	var names []string
+	for _, name := range bits {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func indexOf(s []string, v string) int {
+	if v == "" {
+		return -1
+	}
+	for i, e := range s {
+		if e == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// s6aOptions returns options with the AVPs of an S6a request added:
+// Auth-Session-State, User-Name from Ueimsi and then avps, each unless the
+// script adds it itself.
+func s6aOptions(options ConnectionOptions, avps ...AVP) (ConnectionOptions, error) {
+	base := []AVP{{Key: "Auth-Session-State", Value: int64(authSessionStateNoStateMaintained)}}
+	if options.Ueimsi != "" {
+		base = append(base, AVP{Key: "User-Name", Value: options.Ueimsi})
+	} else if !hasAVP(options.Additional, "User-Name") {
+		return options, errors.New("missing ueimsi")
+	}
+	return addAVPs(options, append(base, avps...)), nil
+}
+
+// addAVPs returns options with avps added before its additional AVPs, each
+// unless the script adds it itself.
+func addAVPs(options ConnectionOptions, avps []AVP) ConnectionOptions {
+	var added []AVP
+	for _, a := range avps {
+		if !hasAVP(options.Additional, a.Key) {
+			added = append(added, a)
+		}
+	}
+	options.Additional = append(added, options.Additional...)
+	return options
+}
+
+func hasAVP(avps []AVP, key string) bool {
+	for _, a := range avps {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func purOptions(options ConnectionOptions) (ConnectionOptions, error) {
+	var avps []AVP
+	if options.PurFlags != nil {
+		avps = append(avps, AVP{Key: "PUR-Flags", Value: int64(*options.PurFlags)})
+	}
+	return s6aOptions(options, avps...)
+}
+
+func norOptions(options ConnectionOptions) (ConnectionOptions, error) {
+	var avps []AVP
+	if options.NorFlags != nil {
+		avps = append(avps, AVP{Key: "NOR-Flags", Value: int64(*options.NorFlags)})
+	}
+	return s6aOptions(options, avps...)
+}
+
+// SendPUR sends a Purge-UE-Request for the subscriber Ueimsi without
+// waiting for the answer.
+func (c *K6DiameterClient) SendPUR(v sobek.Value) (bool, error) {
+	options, err := parseConnectionOptions(v)
+	if err == nil {
+		options, err = purOptions(options)
+	}
+	if err != nil {
+		return false, err
+	}
+	return c.pick().send(diam.PurgeUE, diam.TGPP_S6A_APP_ID, options)
+}
+
+// CheckSendPUR sends a Purge-UE-Request for the subscriber Ueimsi and
+// returns the answer, whose PUA-Flags decodeFlags decodes.
+func (c *K6DiameterClient) CheckSendPUR(v sobek.Value) (*Answer, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendPUR(options)
+}
+
+func (c *K6DiameterClient) checkSendPUR(options ConnectionOptions) (*Answer, error) {
+	options, err := purOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendS6a(diam.PurgeUE, options)
+}
+
+// SendNOR sends a Notify-Request for the subscriber Ueimsi without waiting
+// for the answer.
+func (c *K6DiameterClient) SendNOR(v sobek.Value) (bool, error) {
+	options, err := parseConnectionOptions(v)
+	if err == nil {
+		options, err = norOptions(options)
+	}
+	if err != nil {
+		return false, err
+	}
+	return c.pick().send(diam.Notify, diam.TGPP_S6A_APP_ID, options)
+}
+
+// CheckSendNOR sends a Notify-Request for the subscriber Ueimsi and returns
+// the answer.
+func (c *K6DiameterClient) CheckSendNOR(v sobek.Value) (*Answer, error) {
+	options, err := parseConnectionOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendNOR(options)
+}
+
+func (c *K6DiameterClient) checkSendNOR(options ConnectionOptions) (*Answer, error) {
+	options, err := norOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkSendS6a(diam.Notify, options)
+}
+
+func (c *K6DiameterClient) checkSendS6a(code uint32, options ConnectionOptions) (*Answer, error) {
+	a, err := c.pick().checkSend(code, diam.TGPP_S6A_APP_ID, options)
+	if errors.Is(err, errTimeout) {
+		return nil, errors.Errorf("%s timeout", commandName(diam.TGPP_S6A_APP_ID, code))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAnswer(a), nil
+}
+
+// addS6aAnswerAVPs adds the AVPs TS 29.272 requires in answers to the S6a
+// requests of the HSS (CLR, IDR, DSR and RSR) besides the result: the
+// Vendor-Specific-Application-Id and Auth-Session-State of the request,
+// NO_STATE_MAINTAINED when it has none. TS 29.229 requires the same in
+// answers to its Cx requests (RTR and PPR).
+func addS6aAnswerAVPs(a, req *diam.Message) {
+	if vsa, err := req.FindAVP(avp.VendorSpecificApplicationID, 0); err == nil {
+		a.AddAVP(vsa)
+	}
+	if state, err := req.FindAVP(avp.AuthSessionState, 0); err == nil {
+		a.AddAVP(state)
+		return
+	}
+	a.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(authSessionStateNoStateMaintained))
+}
@@ -0,0 +1,151 @@
+package diameter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		flags   string
+		set     map[string]interface{}
+		want    uint32
+		wantErr bool
+	}{
+		{
+			name:  "ULR attach",
+			flags: "ULR-Flags",
+			set:   map[string]interface{}{"s6a_s6d_indicator": true, "initial_attach_indicator": true},
+			want:  ULR_FLAGS,
+		},
+		{
+			name:  "cleared bits",
+			flags: "PUR-Flags",
+			set:   map[string]interface{}{"ue_purged_in_mme": true, "ue_purged_in_sgsn": false},
+			want:  1,
+		},
+		{
+			name:  "after reserved bit",
+			flags: "NOR-Flags",
+			set:   map[string]interface{}{"ue_reachable_from_sgsn": true},
+			want:  1 << 5,
+		},
+		{
+			name:  "empty",
+			flags: "IDR-Flags",
+			set:   map[string]interface{}{},
+			want:  0,
+		},
+		{
+			name:    "unknown AVP",
+			flags:   "XYZ-Flags",
+			set:     map[string]interface{}{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown bit",
+			flags:   "CLR-Flags",
+			set:     map[string]interface{}{"ue_purged_in_mme": true},
+			wantErr: true,
+		},
+		{
+			name:    "reserved bit",
+			flags:   "NOR-Flags",
+			set:     map[string]interface{}{"": true},
+			wantErr: true,
+		},
+		{
+			name:    "not a boolean",
+			flags:   "CLR-Flags",
+			set:     map[string]interface{}{"reattach_required": int64(1)},
+			wantErr: true,
+		},
+	}
+	mi := &ModuleInstance{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := mi.Flags(tt.flags, tt.set)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Flags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Flags() = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeFlags(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		flags   string
+		value   int64
+		want    map[string]bool
+		wantErr bool
+	}{
+		{
+			name:  "ULA",
+			flags: "ULA-Flags",
+			value: 1 << 1,
+			want:  map[string]bool{"separation_indication": false, "mme_registered_for_sms": true},
+		},
+		{
+			name:  "undefined bits ignored",
+			flags: "PUA-Flags",
+			value: 1 | 1<<8,
+			want:  map[string]bool{"freeze_m_tmsi": true, "freeze_p_tmsi": false},
+		},
+		{
+			name:    "unknown AVP",
+			flags:   "XYZ-Flags",
+			wantErr: true,
+		},
+	}
+	mi := &ModuleInstance{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := mi.DecodeFlags(tt.flags, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeFlags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagsRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	mi := &ModuleInstance{}
+	for name, bits := range s6aFlags {
+		set := make(map[string]interface{})
+		for _, bit := range bitNames(bits) {
+			set[bit] = true
+		}
+		value, err := mi.Flags(name, set)
+		if err != nil {
+			t.Fatalf("Flags(%s) error = %v", name, err)
+		}
+		decoded, err := mi.DecodeFlags(name, int64(value))
+		if err != nil {
+			t.Fatalf("DecodeFlags(%s) error = %v", name, err)
+		}
+		for bit, on := range decoded {
+			if !on {
+				t.Errorf("DecodeFlags(%s)[%s] = false, want true", name, bit)
+			}
+		}
+		if len(decoded) != len(set) {
+			t.Errorf("DecodeFlags(%s) has %d bits, want %d", name, len(decoded), len(set))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package diameter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ishidawataru/sctp"
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+
+	"github.com/bbsakura/xk6-diameter/pkg/sctpconn"
+)
+
+// SCTPOptions tunes SCTP associations. LocalAddrs are the local IP addresses
+// to bind, and RemoteAddrs further IP addresses of the peer, for
+// multi-homing. Ppid is the payload protocol identifier, 46 (Diameter) by
+// default or 47 (Diameter in a DTLS/SCTP DATA chunk).
+type SCTPOptions struct {
+	LocalAddrs  []string
+	RemoteAddrs []string
+	Ostreams    uint
+	Istreams    uint
+	Ppid        uint
+}
+
+func isSCTP(network string) bool {
+	return strings.HasPrefix(network, "sctp")
+}
+
+// dialSCTP establishes an SCTP association with the peer at addr.
+func dialSCTP(network, addr string, o *SCTPOptions) (net.Conn, error) {
+	if o == nil {
+		o = &SCTPOptions{}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := sctp.ResolveSCTPAddr(network, net.JoinHostPort(strings.Join(append([]string{host}, o.RemoteAddrs...), "/"), port))
+	if err != nil {
+		return nil, errors.WithMessage(err, "sctp remote_addrs")
+	}
+	var laddr *sctp.SCTPAddr
+	if len(o.LocalAddrs) > 0 {
+		if laddr, err = sctp.ResolveSCTPAddr(network, strings.Join(o.LocalAddrs, "/")+":0"); err != nil {
+			return nil, errors.WithMessage(err, "sctp local_addrs")
+		}
+	}
+	conn, err := sctp.DialSCTPExt(network, laddr, raddr, o.initMsg())
+	if err != nil {
+		return nil, err
+	}
+	return sctpconn.New(conn, o.ppid()), nil
+}
+
+// sctpOptions returns the SCTP options, binding LocalAddr unless local
+// addresses are configured.
+func (co ConnectionOptions) sctpOptions() *SCTPOptions {
+	o := SCTPOptions{}
+	if co.SCTP != nil {
+		o = *co.SCTP
+	}
+	if len(o.LocalAddrs) == 0 && co.LocalAddr != "" {
+		o.LocalAddrs = []string{co.LocalAddr}
+	}
+	return &o
+}
+
+func (o *SCTPOptions) initMsg() sctp.InitMsg {
+	msg := sctp.InitMsg{
+		NumOstreams:  diam.MaxOutboundSCTPStreams,
+		MaxInstreams: diam.MaxInboundSCTPStreams,
+	}
+	if o.Ostreams > 0 {
+		msg.NumOstreams = uint16(o.Ostreams)
+	}
+	if o.Istreams > 0 {
+		msg.MaxInstreams = uint16(o.Istreams)
+	}
+	return msg
+}
+
+func (o *SCTPOptions) ppid() uint32 {
+	if o.Ppid == 0 {
+		return diam.DiameterPPID
+	}
+	return uint32(o.Ppid)
+}
+
+// validate checks the SCTP options before connecting.
+func (o *SCTPOptions) validate() error {
+	for _, ip := range append(append([]string{}, o.LocalAddrs...), o.RemoteAddrs...) {
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid sctp address `%s`", ip)
+		}
+	}
+	if o.Ostreams > 0xffff || o.Istreams > 0xffff {
+		return errors.New("sctp ostreams and istreams must be at most 65535")
+	}
+	if o.Ppid > 0xffffffff {
+		return errors.Errorf("invalid sctp ppid %d", o.Ppid)
+	}
+	return nil
+}
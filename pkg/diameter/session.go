@@ -0,0 +1,183 @@
+package diameter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// sessionInboxSize is the number of unclaimed requests kept per session.
+const sessionInboxSize = 16
+
+type sessionState int
+
+const (
+	sessionIdle sessionState = iota
+	sessionOpen
+	sessionTerminated
+)
+
+// sessionRequest is the place of a request in its session.
+type sessionRequest int
+
+const (
+	sessionInitial sessionRequest = iota
+	sessionUpdate
+	sessionTermination
+)
+
+// session is a session of a script with the peer, e.g. a Gx or Rx session:
+// the Session-Id of its requests and its state. While it is open, the
+// requests the peer sends for the session, e.g. Re-Auth-Requests, are kept
+// for the script in its inbox rather than in the inbox of their command.
+type session struct {
+	client  *K6DiameterClient
+	appID   uint32
+	id      string
+	options ConnectionOptions
+	inbox   chan *InboundRequest
+
+	// received applies a request of the peer to the state of the session
+	// before it is answered.
+	received func(m *diam.Message)
+
+	// sending serialises the requests of the session, so that they are
+	// answered in turn and numbered in the order they are sent.
+	sending sync.Mutex
+
+	mu    sync.Mutex
+	state sessionState
+}
+
+// newSession returns a session of the application appID on a connection of
+// c. The requests of the session carry options, whose SessionID is the
+// Session-Id of the session when set.
+func newSession(c *K6DiameterClient, appID uint32, options ConnectionOptions) (*session, error) {
+	c = c.pick()
+	if c.inbound == nil {
+		return nil, errors.New("not connected")
+	}
+	s := &session{
+		client:  c,
+		appID:   appID,
+		id:      options.SessionID,
+		options: options,
+		inbox:   make(chan *InboundRequest, sessionInboxSize),
+	}
+	if s.id == "" {
+		s.id = c.generateSessionID()
+	}
+	s.options.SessionID = s.id
+	return s, nil
+}
+
+// check returns why request cannot be sent in the state of the session, if
+// it cannot. Callers hold mu.
+func (s *session) check(request sessionRequest) error {
+	switch {
+	case s.state == sessionTerminated:
+		return errors.Errorf("session %s is terminated", s.id)
+	case request == sessionInitial && s.state != sessionIdle:
+		return errors.Errorf("session %s is already initiated", s.id)
+	case request != sessionInitial && s.state == sessionIdle:
+		return errors.Errorf("session %s is not initiated", s.id)
+	}
+	return nil
+}
+
+// begin registers the session for the requests of the peer before its
+// initial request is sent, as they may follow its answer closely. Callers
+// hold mu.
+func (s *session) begin(request sessionRequest) {
+	if request == sessionInitial {
+		s.client.inbound.addSession(s)
+	}
+}
+
+// end updates the state of the session once request was answered with a,
+// or failed: an initial request answered with success opens the session and
+// a termination request answered with success terminates it. A failed or
+// rejected initial request leaves it idle, to be sent again. Callers hold
+// mu.
+func (s *session) end(request sessionRequest, a *diam.Message) {
+	succeeded := false
+	if a != nil {
+		ex := exchange{}
+		ex.ResultCode, ex.ExperimentalResultCode = resultCodes(a)
+		succeeded = !ex.failed()
+	}
+	switch {
+	case request == sessionInitial && succeeded:
+		s.state = sessionOpen
+	case request == sessionInitial:
+		s.client.inbound.removeSession(s)
+	case request == sessionTermination && succeeded:
+		s.state = sessionTerminated
+		s.client.inbound.removeSession(s)
+	}
+}
+
+// send sends the request code of the session, with the options build
+// returns, and waits for its answer. The requests of the session are sent
+// one at a time.
+func (s *session) send(request sessionRequest, code uint32, build func() (ConnectionOptions, error)) (*diam.Message, error) {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	return s.sendLocked(request, code, build)
+}
+
+// sendLocked is send for callers holding sending. build is called with mu
+// held, after checking that request can be sent in the state of the
+// session, which changes only once it is answered with success.
+func (s *session) sendLocked(request sessionRequest, code uint32, build func() (ConnectionOptions, error)) (*diam.Message, error) {
+	s.mu.Lock()
+	err := s.check(request)
+	var options ConnectionOptions
+	if err == nil {
+		options, err = build()
+	}
+	if err == nil {
+		s.begin(request)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.exchange(code, options)
+	s.mu.Lock()
+	s.end(request, a)
+	s.mu.Unlock()
+	return a, err
+}
+
+// request returns the options of a request of the session with avps
+// followed by the additional AVPs of the session.
+func (s *session) request(avps []AVP) ConnectionOptions {
+	options := s.options
+	options.Additional = append(append([]AVP{}, avps...), s.options.Additional...)
+	return options
+}
+
+// exchange sends the request code of the session with options and waits
+// for its answer.
+func (s *session) exchange(code uint32, options ConnectionOptions) (*diam.Message, error) {
+	a, err := s.client.checkSend(code, s.appID, options)
+	if errors.Is(err, errTimeout) {
+		return nil, errors.Errorf("%s timeout", commandName(s.appID, code))
+	}
+	return a, err
+}
+
+// waitRequest waits up to wait seconds for a request of the peer for the
+// session.
+func (s *session) waitRequest(wait int64) (*InboundRequest, error) {
+	select {
+	case req := <-s.inbox:
+		return s.client.answerReceived(req)
+	case <-time.After(time.Duration(wait) * time.Second):
+		return nil, errors.Errorf("no request for session %s", s.id)
+	}
+}
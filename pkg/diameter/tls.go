@@ -0,0 +1,171 @@
+package diameter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// inbandSecurityTLS is the TLS value of Inband-Security-Id.
+const inbandSecurityTLS = 1
+
+// TLSOptions configures TLS to the peer. Ca, Cert and Key are PEM encoded,
+// e.g. read with open() in the init context. A Cert and Key enable mutual
+// TLS.
+type TLSOptions struct {
+	Ca                 string
+	Cert               string
+	Key                string
+	ServerName         string
+	InsecureSkipVerify bool
+	MinVersion         string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// config returns the TLS configuration to connect to the peer at addr.
+func (o *TLSOptions) config(addr string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.WithMessage(err, "tls server_name")
+		}
+		cfg.ServerName = host
+	}
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(o.MinVersion), "tls")]
+		if !ok {
+			return nil, errors.Errorf("unsupported tls min_version `%s`", o.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if o.Ca != "" {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM([]byte(o.Ca)) {
+			return nil, errors.New("no certificate found in tls ca")
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(o.Cert), []byte(o.Key))
+		if err != nil {
+			return nil, errors.WithMessage(err, "tls cert/key")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// dialTLS connects to the peer at addr over TLS and reports the duration of
+// the handshake.
+func (c *K6DiameterClient) dialTLS(network, addr string) (net.Conn, error) {
+	network = defaultNetwork(network)
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errors.Errorf("tls is not supported over %s", network)
+	}
+	cfg, err := c.options.TLS.config(addr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.dialer().Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.handshakeTLS(raw, cfg)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshakeTLS runs the client TLS handshake on raw.
+func (c *K6DiameterClient) handshakeTLS(raw net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	conn := tls.Client(raw, cfg)
+	start := time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+	c.reportTLSHandshake(start, raw.RemoteAddr().String(), conn.ConnectionState().Version)
+	return conn, nil
+}
+
+// dialInbandTLS connects to the peer at addr, runs the capabilities exchange
+// in the clear and then upgrades the connection to TLS, as negotiated with
+// Inband-Security-Id (RFC 6733 section 6.10). The TLS options, if any,
+// configure the upgrade.
+func (c *K6DiameterClient) dialInbandTLS(addr string, handler diam.Handler) (diam.Conn, *CapabilitiesExchange, error) {
+	network := defaultNetwork(c.options.NetworkType)
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, nil, errors.Errorf("tls is not supported over %s", network)
+	}
+	options := c.options.TLS
+	if options == nil {
+		options = &TLSOptions{}
+	}
+	cfg, err := options.config(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := c.dialer().Dial(network, addr)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "Dial error")
+	}
+	// The CEA is read before the connection is handed to go-diameter, whose
+	// reader would otherwise consume the TLS handshake. Nothing else is read
+	// in the clear: any other message fails the connection.
+	ceac := make(chan *diam.Message, 1)
+	errc := make(chan error, 1)
+	go func() {
+		m, err := diam.ReadMessage(raw, dict.Default)
+		switch {
+		case err != nil:
+			errc <- errors.WithMessage(err, "read CEA")
+		case m.Header.CommandCode != diam.CapabilitiesExchange || m.Header.CommandFlags&diam.RequestFlag != 0:
+			errc <- errors.Errorf("%s received before the TLS upgrade", commandName(m.Header.ApplicationID, m.Header.CommandCode))
+		default:
+			ceac <- m
+		}
+	}()
+	cea, err := c.exchangeCapabilities(raw, raw.LocalAddr(), addr, ceac, errc)
+	if err == nil && cea.InbandSecurityId != inbandSecurityTLS {
+		err = errors.Errorf("peer %s did not agree to in-band TLS", addr)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	tlsConn, err := c.handshakeTLS(raw, cfg)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	conn, err := diam.NewConn(tlsConn, addr, handler, dict.Default)
+	if err != nil {
+		tlsConn.Close()
+		return nil, nil, err
+	}
+	setPeerMetadata(conn, cea)
+	return conn, cea, nil
+}
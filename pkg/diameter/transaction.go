@@ -0,0 +1,128 @@
+package diameter
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+var (
+	errTimeout        = errors.New("answer timeout")
+	errConnectionLost = errors.New("connection lost before answer")
+)
+
+// pendingTable correlates answers with the outstanding requests they belong
+// to, using the Hop-by-Hop and End-to-End identifiers of the message header.
+type pendingTable struct {
+	mu      sync.Mutex
+	pending map[uint32]*transaction
+}
+
+type transaction struct {
+	hopByHop uint32
+	endToEnd uint32
+	answer   chan *diam.Message
+}
+
+func newPendingTable() *pendingTable {
+	return &pendingTable{
+		pending: make(map[uint32]*transaction),
+	}
+}
+
+// add registers m as outstanding. The Hop-by-Hop identifier of m is
+// regenerated when it collides with another outstanding request.
+func (t *pendingTable) add(m *diam.Message) *transaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if _, ok := t.pending[m.Header.HopByHopID]; !ok {
+			break
+		}
+		m.Header.HopByHopID = rand.Uint32()
+	}
+	tx := &transaction{
+		hopByHop: m.Header.HopByHopID,
+		endToEnd: m.Header.EndToEndID,
+		answer:   make(chan *diam.Message, 1),
+	}
+	t.pending[tx.hopByHop] = tx
+	return tx
+}
+
+func (t *pendingTable) remove(tx *transaction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[tx.hopByHop] == tx {
+		delete(t.pending, tx.hopByHop)
+	}
+}
+
+// forget registers m as outstanding without anyone waiting for its answer,
+// which is discarded when it arrives within timeout instead of being late.
+func (t *pendingTable) forget(m *diam.Message, timeout time.Duration) *transaction {
+	tx := t.add(m)
+	time.AfterFunc(timeout, func() { t.remove(tx) })
+	return tx
+}
+
+// deliver hands the answer m to the request waiting for it. It returns false
+// for answers that do not match an outstanding request, e.g. because it
+// already timed out, which are late and discarded.
+func (t *pendingTable) deliver(m *diam.Message) bool {
+	t.mu.Lock()
+	tx, ok := t.pending[m.Header.HopByHopID]
+	if !ok || tx.endToEnd != m.Header.EndToEndID {
+		t.mu.Unlock()
+		return false
+	}
+	delete(t.pending, tx.hopByHop)
+	t.mu.Unlock()
+	tx.answer <- m
+	return true
+}
+
+// abort fails all outstanding requests, e.g. because their connection was
+// lost.
+func (t *pendingTable) abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for hopByHop, tx := range t.pending {
+		delete(t.pending, hopByHop)
+		tx.answer <- nil
+	}
+}
+
+// len returns the number of outstanding requests.
+func (t *pendingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// roundTrip writes m to the connection and waits for the answer correlated
+// to it.
+func (c *K6DiameterClient) roundTrip(m *diam.Message, timeout time.Duration) (*diam.Message, error) {
+	conn := c.conn()
+	if conn == nil {
+		return nil, errors.New("not connected")
+	}
+	tx := c.pending.add(m)
+	if _, err := m.WriteTo(conn); err != nil {
+		c.pending.remove(tx)
+		return nil, err
+	}
+	select {
+	case a := <-tx.answer:
+		if a == nil {
+			return nil, errConnectionLost
+		}
+		return a, nil
+	case <-time.After(timeout):
+		c.pending.remove(tx)
+		return nil, errTimeout
+	}
+}
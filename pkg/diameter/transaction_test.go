@@ -0,0 +1,147 @@
+package diameter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+func newTestRequest(hopByHop, endToEnd uint32) *diam.Message {
+	m := diam.NewRequest(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, dict.Default)
+	m.Header.HopByHopID = hopByHop
+	m.Header.EndToEndID = endToEnd
+	return m
+}
+
+func newTestAnswer(hopByHop, endToEnd uint32) *diam.Message {
+	return newTestRequest(hopByHop, endToEnd).Answer(diam.Success)
+}
+
+func TestPendingTableDeliver(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		answer  *diam.Message
+		matched bool
+	}{
+		{"matching", newTestAnswer(1, 10), true},
+		{"other Hop-by-Hop", newTestAnswer(2, 10), false},
+		{"other End-to-End", newTestAnswer(1, 11), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			table := newPendingTable()
+			tx := table.add(newTestRequest(1, 10))
+			if got := table.deliver(tt.answer); got != tt.matched {
+				t.Fatalf("deliver() = %v, want %v", got, tt.matched)
+			}
+			select {
+			case a := <-tx.answer:
+				if !tt.matched || a != tt.answer {
+					t.Errorf("request got answer %v", a)
+				}
+			default:
+				if tt.matched {
+					t.Error("request got no answer")
+				}
+			}
+			want := 1
+			if tt.matched {
+				want = 0
+			}
+			if n := table.len(); n != want {
+				t.Errorf("len() = %d, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestPendingTableHopByHopCollision(t *testing.T) {
+	t.Parallel()
+
+	table := newPendingTable()
+	first := newTestRequest(1, 10)
+	second := newTestRequest(1, 11)
+	table.add(first)
+	table.add(second)
+	if second.Header.HopByHopID == first.Header.HopByHopID {
+		t.Fatal("add() kept a colliding Hop-by-Hop identifier")
+	}
+	if !table.deliver(newTestAnswer(second.Header.HopByHopID, 11)) {
+		t.Error("deliver() did not match the regenerated Hop-by-Hop identifier")
+	}
+	if !table.deliver(newTestAnswer(1, 10)) {
+		t.Error("deliver() did not match the first request")
+	}
+}
+
+func TestPendingTableLateAnswer(t *testing.T) {
+	t.Parallel()
+
+	table := newPendingTable()
+	tx := table.add(newTestRequest(1, 10))
+	// The request timed out.
+	table.remove(tx)
+	if table.deliver(newTestAnswer(1, 10)) {
+		t.Error("deliver() matched the answer of a removed request")
+	}
+	if n := table.len(); n != 0 {
+		t.Errorf("len() = %d, want 0", n)
+	}
+}
+
+func TestPendingTableRemoveReused(t *testing.T) {
+	t.Parallel()
+
+	table := newPendingTable()
+	old := table.add(newTestRequest(1, 10))
+	table.deliver(newTestAnswer(1, 10))
+	table.add(newTestRequest(1, 11))
+	// Removing the answered request keeps the one reusing its identifier.
+	table.remove(old)
+	if !table.deliver(newTestAnswer(1, 11)) {
+		t.Error("deliver() did not match the request reusing the Hop-by-Hop identifier")
+	}
+}
+
+func TestPendingTableForget(t *testing.T) {
+	t.Parallel()
+
+	table := newPendingTable()
+	table.forget(newTestRequest(1, 10), time.Hour)
+	if !table.deliver(newTestAnswer(1, 10)) {
+		t.Error("deliver() did not match the answer within the timeout")
+	}
+
+	table.forget(newTestRequest(2, 20), time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for table.len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if table.deliver(newTestAnswer(2, 20)) {
+		t.Error("deliver() matched the answer after the timeout")
+	}
+}
+
+func TestPendingTableAbort(t *testing.T) {
+	t.Parallel()
+
+	table := newPendingTable()
+	txs := []*transaction{
+		table.add(newTestRequest(1, 10)),
+		table.add(newTestRequest(2, 20)),
+	}
+	table.abort()
+	for _, tx := range txs {
+		if a := <-tx.answer; a != nil {
+			t.Errorf("aborted request got answer %v", a)
+		}
+	}
+	if n := table.len(); n != 0 {
+		t.Errorf("len() = %d, want 0", n)
+	}
+}
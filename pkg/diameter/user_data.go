@@ -0,0 +1,108 @@
+package diameter
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IMSSubscription is the IMS subscription of a User-Data AVP, the XML
+// document the HSS downloads to the S-CSCF (TS 29.228 annex E).
+type IMSSubscription struct {
+	XMLName         xml.Name          `xml:"IMSSubscription" js:"-"`
+	PrivateId       string            `xml:"PrivateID"`
+	ServiceProfiles []*ServiceProfile `xml:"ServiceProfile"`
+}
+
+// ServiceProfile is the service profile of some public identities.
+type ServiceProfile struct {
+	PublicIdentities         []*PublicIdentity        `xml:"PublicIdentity"`
+	SubscribedMediaProfileId *int                     `xml:"CoreNetworkServicesAuthorization>SubscribedMediaProfileId"`
+	InitialFilterCriteria    []*InitialFilterCriteria `xml:"InitialFilterCriteria"`
+	SharedIfcSetIds          []int                    `xml:"SharedIFCSetID"`
+}
+
+// PublicIdentity is a public identity of a service profile. IdentityType is
+// 0 for a distinct public user identity, 1 for a distinct PSI and 2 for a
+// wildcarded PSI.
+type PublicIdentity struct {
+	Identity          string `xml:"Identity"`
+	BarringIndication bool   `xml:"BarringIndication"`
+	DisplayName       string `xml:"DisplayName"`
+	IdentityType      *int   `xml:"Extension>IdentityType"`
+}
+
+// InitialFilterCriteria routes the SIP requests matching TriggerPoint to
+// ApplicationServer.
+type InitialFilterCriteria struct {
+	Priority             int                `xml:"Priority"`
+	TriggerPoint         *TriggerPoint      `xml:"TriggerPoint"`
+	ApplicationServer    *ApplicationServer `xml:"ApplicationServer"`
+	ProfilePartIndicator *int               `xml:"ProfilePartIndicator"`
+}
+
+// TriggerPoint is the condition of an initial filter criteria, its SPTs in
+// conjunctive (ConditionTypeCnf) or disjunctive normal form.
+type TriggerPoint struct {
+	ConditionTypeCnf bool                   `xml:"ConditionTypeCNF"`
+	Spts             []*ServicePointTrigger `xml:"SPT"`
+}
+
+// ServicePointTrigger matches one property of a SIP request. SessionCase is
+// 0 for originating, 1 for terminating registered, 2 for terminating
+// unregistered, 3 for originating unregistered and 4 for originating CDIV
+// requests.
+type ServicePointTrigger struct {
+	ConditionNegated   bool                `xml:"ConditionNegated"`
+	Groups             []int               `xml:"Group"`
+	RequestUri         string              `xml:"RequestURI"`
+	Method             string              `xml:"Method"`
+	SipHeader          *SIPHeader          `xml:"SIPHeader"`
+	SessionCase        *int                `xml:"SessionCase"`
+	SessionDescription *SessionDescription `xml:"SessionDescription"`
+}
+
+// SIPHeader matches the SIP header Header whose value matches Content.
+type SIPHeader struct {
+	Header  string `xml:"Header"`
+	Content string `xml:"Content"`
+}
+
+// SessionDescription matches the SDP lines Line whose value matches Content.
+type SessionDescription struct {
+	Line    string `xml:"Line"`
+	Content string `xml:"Content"`
+}
+
+// ApplicationServer is the application server of an initial filter
+// criteria. DefaultHandling is 0 to continue and 1 to terminate the session
+// when the server cannot be reached.
+type ApplicationServer struct {
+	ServerName      string `xml:"ServerName"`
+	DefaultHandling *int   `xml:"DefaultHandling"`
+	ServiceInfo     string `xml:"ServiceInfo"`
+}
+
+// DecodeUserData decodes the IMS subscription of a User-Data AVP, given as
+// its XML document or, as decoded in avps, hex encoded: e.g.
+// decodeUserData(ppr.avps["User-Data"]).
+func (mi *ModuleInstance) DecodeUserData(value string) (*IMSSubscription, error) {
+	return decodeUserData(value)
+}
+
+func decodeUserData(value string) (*IMSSubscription, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "<") {
+		var err error
+		if data, err = hex.DecodeString(value); err != nil {
+			return nil, errors.New("invalid User-Data: want an XML document or its hex encoding")
+		}
+	}
+	var s IMSSubscription
+	if err := xml.Unmarshal(data, &s); err != nil {
+		return nil, errors.WithMessage(err, "decode User-Data")
+	}
+	return &s, nil
+}
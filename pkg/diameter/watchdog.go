@@ -0,0 +1,149 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.k6.io/k6/errext"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+)
+
+// Watchdog policies, applied when the peer stops answering DWRs.
+const (
+	// watchdogFailFast fails requests immediately until a DWA arrives again.
+	watchdogFailFast = "fail_fast"
+	// watchdogReconnect replaces the connection to the peer.
+	watchdogReconnect = "reconnect"
+	// watchdogAbort aborts the test at the next request on the connection.
+	watchdogAbort = "abort"
+)
+
+var errPeerDown = errors.New("peer down: no answer to Device-Watchdog")
+
+// watchdog sends a DWR every interval. Following RFC 3539, the peer is
+// considered down when two DWRs in a row are not answered.
+type watchdog struct {
+	interval time.Duration
+	policy   string
+	down     atomic.Bool
+	aborted  atomic.Bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func parseWatchdogPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return watchdogFailFast, nil
+	case watchdogFailFast, watchdogReconnect, watchdogAbort:
+		return policy, nil
+	}
+	return "", errors.Errorf("invalid watchdog_policy %q: want %s, %s or %s",
+		policy, watchdogFailFast, watchdogReconnect, watchdogAbort)
+}
+
+func newWatchdog(interval time.Duration, policy string) *watchdog {
+	return &watchdog{
+		interval: interval,
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+}
+
+// failFast reports whether requests must fail because the peer is down.
+func (w *watchdog) failFast() bool {
+	return w.policy == watchdogFailFast && w.down.Load()
+}
+
+func (w *watchdog) close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (c *K6DiameterClient) runWatchdog(w *watchdog) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		if state, _ := c.link.status(); state != peerOpen {
+			missed = 0
+			continue
+		}
+		start := time.Now()
+		a, err := c.roundTrip(c.newDWR(), w.interval)
+		if err == nil {
+			if resultCode, _ := resultCodes(a); !isSuccess(resultCode) {
+				err = errors.Errorf("DWA with Result-Code %d", resultCode)
+			}
+		}
+		c.reportWatchdog(start, err)
+		if err == nil {
+			missed = 0
+			w.down.Store(false)
+			continue
+		}
+		if missed++; missed < 2 {
+			continue
+		}
+
+		w.down.Store(true)
+		switch w.policy {
+		case watchdogReconnect:
+			// The connection is established again by supervise.
+			if conn := c.conn(); conn != nil {
+				conn.Close()
+			}
+			missed = 0
+			w.down.Store(false)
+		case watchdogAbort:
+			// The watchdog runs outside of the VUs, which abort the test
+			// from their own runtime when they next use the connection.
+			w.aborted.Store(true)
+			return
+		}
+	}
+}
+
+// abortTest interrupts the VU of c with the test abort error, which k6 turns
+// into aborting the whole test as execution.test.abort() does.
+func (c *K6DiameterClient) abortTest() error {
+	err := &errext.InterruptError{
+		Reason: fmt.Sprintf("%s: %s from %s", errext.AbortTest, errPeerDown, c.options.Addr),
+	}
+	c.vu.Runtime().Interrupt(err)
+	return err
+}
+
+func (c *K6DiameterClient) newDWR() *diam.Message {
+	m := diam.NewRequest(diam.DeviceWatchdog, 0, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, c.cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, c.cfg.OriginRealm)
+	m.NewAVP(avp.OriginStateID, avp.Mbit, 0, c.cfg.OriginStateID)
+	return m
+}
+
+// handleDWR answers the Device-Watchdog-Requests of the peer.
+func handleDWR(cfg *sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		a := m.Answer(diam.Success)
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+		a.NewAVP(avp.OriginStateID, avp.Mbit, 0, cfg.OriginStateID)
+		if _, err := a.WriteTo(c); err != nil {
+			log.Println(errors.WithMessage(err, "write DWA fail"))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package sctpconn wraps go-diameter SCTP connections to write with a chosen
+// payload protocol identifier.
+package sctpconn
+
+import (
+	"github.com/ishidawataru/sctp"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// Conn is a go-diameter SCTP connection writing with its own payload
+// protocol identifier.
+type Conn struct {
+	*diam.SCTPConn
+	ppid uint32
+}
+
+// New returns the connection of the association conn writing with ppid.
+func New(conn *sctp.SCTPConn, ppid uint32) *Conn {
+	return &Conn{
+		SCTPConn: diam.NewSCTPConn(conn).(*diam.SCTPConn),
+		ppid:     ppid,
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	stream := c.CurrentWriterStream()
+	if stream == diam.InvalidStreamID {
+		stream = c.CurrentStream()
+	}
+	return c.WriteStream(b, stream)
+}
+
+// WriteStream writes b on stream, or on the default stream if it is
+// diam.InvalidStreamID.
+func (c *Conn) WriteStream(b []byte, stream uint) (int, error) {
+	info := &sctp.SndRcvInfo{PPID: c.ppid}
+	if stream != diam.InvalidStreamID {
+		info.Stream = uint16(stream)
+	}
+	return c.SCTPWrite(b, info)
+}
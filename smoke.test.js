@@ -23,6 +23,7 @@ export default function () {
             network_type: "sctp",
             retries: 0,
             vendor_id: 10415,
+            app_id: 16777251,
             product_name: "xk6-diameter",
             hostipaddresses: ["127.0.0.1"],
         });